@@ -0,0 +1,673 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exprError is a problem at a byte offset of an expression, rule files turn it into a line and column.
+type exprError struct {
+	pos int
+	msg string
+}
+
+func (e *exprError) Error() string {
+	return fmt.Sprintf("offset %d: %s", e.pos, e.msg)
+}
+
+func errorAt(pos int, format string, args ...interface{}) *exprError {
+	return &exprError{pos: pos, msg: fmt.Sprintf(format, args...)}
+}
+
+// tokenKind is the kind of a lexical token of an expression.
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenDuration
+	tokenPath // a metric path, or a function name when followed by (
+	tokenOp   // + - * / > >= < <= == !=
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	num  float64
+	dur  time.Duration
+}
+
+// durationUnits are the units of a duration literal such as 5m or 1h30m, d and w are added to the ones of Go
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour,
+	"d": 24 * time.Hour, "w": 7 * 24 * time.Hour,
+}
+
+// lexExpr splits an expression into tokens.
+func lexExpr(text string) ([]token, error) {
+	tokens := make([]token, 0)
+	i := 0
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '&' || c == '|':
+			if i+1 >= len(text) || text[i+1] != c {
+				return nil, errorAt(i, "unexpected %q, did you mean %c%c", c, c, c)
+			}
+			kind := tokenAnd
+			if c == '|' {
+				kind = tokenOr
+			}
+			tokens = append(tokens, token{kind: kind, text: text[i : i+2], pos: i})
+			i += 2
+		case strings.ContainsRune("+-*/<>=!", rune(c)):
+			op := string(c)
+			if i+1 < len(text) && text[i+1] == '=' && strings.ContainsRune("<>=!", rune(c)) {
+				op += "="
+			}
+			switch op {
+			case "=":
+				return nil, errorAt(i, "unexpected =, use == to compare")
+			case "!":
+				tokens = append(tokens, token{kind: tokenNot, text: op, pos: i})
+			default:
+				tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+			}
+			i += len(op)
+		case c >= '0' && c <= '9' || c == '.':
+			tok, next, err := lexNumber(text, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			i = next
+		case isPathChar(c):
+			start := i
+			for i < len(text) && (isPathChar(text[i]) || text[i] == '.' || text[i] == '[') {
+				if text[i] == '[' {
+					end := strings.IndexByte(text[i:], ']')
+					if end < 0 {
+						return nil, errorAt(i, "unclosed [")
+					}
+					i += end
+				}
+				i++
+			}
+			word := text[start:i]
+			switch strings.ToLower(word) {
+			case "and":
+				tokens = append(tokens, token{kind: tokenAnd, text: word, pos: start})
+			case "or":
+				tokens = append(tokens, token{kind: tokenOr, text: word, pos: start})
+			case "not":
+				tokens = append(tokens, token{kind: tokenNot, text: word, pos: start})
+			default:
+				tokens = append(tokens, token{kind: tokenPath, text: word, pos: start})
+			}
+		default:
+			return nil, errorAt(i, "unexpected character %q", c)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(text)}), nil
+}
+
+// lexNumber reads a number, or a duration when units follow the digits.
+func lexNumber(text string, start int) (token, int, error) {
+	i := start
+	for i < len(text) && (text[i] >= '0' && text[i] <= '9' || text[i] == '.') {
+		i++
+	}
+	if i == len(text) || !isPathChar(text[i]) {
+		num, err := strconv.ParseFloat(text[start:i], 64)
+		if err != nil {
+			return token{}, 0, errorAt(start, "invalid number %q", text[start:i])
+		}
+		return token{kind: tokenNumber, text: text[start:i], pos: start, num: num}, i, nil
+	}
+
+	// a duration is a sequence of number and unit pairs such as 1h30m
+	var total time.Duration
+	i = start
+	for i < len(text) && text[i] >= '0' && text[i] <= '9' {
+		digits := i
+		for i < len(text) && text[i] >= '0' && text[i] <= '9' {
+			i++
+		}
+		units := i
+		for i < len(text) && text[i] >= 'a' && text[i] <= 'z' {
+			i++
+		}
+		unit, ok := durationUnits[text[units:i]]
+		if !ok {
+			return token{}, 0, errorAt(units, "unknown duration unit %q, expected ms, s, m, h, d or w", text[units:i])
+		}
+		n, _ := strconv.Atoi(text[digits:units])
+		total += time.Duration(n) * unit
+	}
+	if i < len(text) && isPathChar(text[i]) {
+		return token{}, 0, errorAt(start, "invalid duration %q", text[start:i+1])
+	}
+	return token{kind: tokenDuration, text: text[start:i], pos: start, dur: total}, i, nil
+}
+
+// valueType is what an expression node evaluates to, checked when the expression is parsed.
+type valueType int
+
+const (
+	typeNumber valueType = iota
+	typeBool
+	typeDuration
+)
+
+var valueTypeNames = map[valueType]string{typeNumber: "a number", typeBool: "a condition", typeDuration: "a duration"}
+
+// nodeKind is the kind of an expression node.
+type nodeKind int
+
+const (
+	nodeNumber nodeKind = iota
+	nodeDuration
+	nodeMetric
+	nodeCall
+	nodeUnary  // - and not
+	nodeBinary // arithmetic, comparisons, and, or
+)
+
+type exprNode struct {
+	kind nodeKind
+	typ  valueType
+	pos  int
+	op   string
+
+	num   float64
+	dur   time.Duration
+	path  metricPath
+	fn    string
+	args  []*exprNode
+	left  *exprNode
+	right *exprNode
+}
+
+// exprFunction describes a function over the history of a metric: its first argument is a metric path, the
+// others are durations, the first of them being the window looked back at.
+type exprFunction struct {
+	durations  int
+	minSamples int
+	eval       func(samples []metricSample, now time.Time, args []time.Duration) float64
+}
+
+var exprFunctions = map[string]exprFunction{
+	"avg_over_time": {durations: 1, minSamples: 1, eval: func(samples []metricSample, _ time.Time, _ []time.Duration) float64 {
+		sum := 0.0
+		for _, s := range samples {
+			sum += s.v
+		}
+		return sum / float64(len(samples))
+	}},
+	"max_over_time": {durations: 1, minSamples: 1, eval: func(samples []metricSample, _ time.Time, _ []time.Duration) float64 {
+		max := math.Inf(-1)
+		for _, s := range samples {
+			max = math.Max(max, s.v)
+		}
+		return max
+	}},
+	"min_over_time": {durations: 1, minSamples: 1, eval: func(samples []metricSample, _ time.Time, _ []time.Duration) float64 {
+		min := math.Inf(1)
+		for _, s := range samples {
+			min = math.Min(min, s.v)
+		}
+		return min
+	}},
+	// delta is the change of a gauge over the window
+	"delta": {durations: 1, minSamples: 2, eval: func(samples []metricSample, _ time.Time, _ []time.Duration) float64 {
+		return samples[len(samples)-1].v - samples[0].v
+	}},
+	// rate is the per second increase of a counter, a value going down is a counter reset
+	"rate": {durations: 1, minSamples: 2, eval: func(samples []metricSample, _ time.Time, _ []time.Duration) float64 {
+		increase := 0.0
+		for i := 1; i < len(samples); i++ {
+			if d := samples[i].v - samples[i-1].v; d >= 0 {
+				increase += d
+			} else {
+				increase += samples[i].v
+			}
+		}
+		elapsed := samples[len(samples)-1].t.Sub(samples[0].t).Seconds()
+		if elapsed <= 0 {
+			return 0
+		}
+		return increase / elapsed
+	}},
+	// predict_linear fits a line through the window by least squares and reads it horizon after now
+	"predict_linear": {durations: 2, minSamples: 2, eval: func(samples []metricSample, now time.Time, args []time.Duration) float64 {
+		var n, sumX, sumY, sumXY, sumXX float64
+		for _, s := range samples {
+			x := s.t.Sub(now).Seconds()
+			n++
+			sumX += x
+			sumY += s.v
+			sumXY += x * s.v
+			sumXX += x * x
+		}
+		slope := 0.0
+		if d := n*sumXX - sumX*sumX; d != 0 {
+			slope = (n*sumXY - sumX*sumY) / d
+		}
+		intercept := (sumY - slope*sumX) / n
+		return intercept + slope*args[1].Seconds()
+	}},
+}
+
+// exprParser is a recursive descent parser, from the loosest binding operator to the tightest:
+// or, and, not, comparisons, + -, * /, unary minus.
+type exprParser struct {
+	tokens []token
+	i      int
+}
+
+func (p *exprParser) peek() token { return p.tokens[p.i] }
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.i]
+	if tok.kind != tokenEOF {
+		p.i++
+	}
+	return tok
+}
+
+// describe names a token in an error message.
+func describe(tok token) string {
+	if tok.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(tok.text)
+}
+
+// expect checks the type of an operand.
+func expect(node *exprNode, typ valueType, context string) error {
+	if node.typ != typ {
+		return errorAt(node.pos, "%s needs %s, got %s", context, valueTypeNames[typ], valueTypeNames[node.typ])
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (*exprNode, error) {
+	return p.parseLogical(tokenOr, "or", p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (*exprNode, error) {
+	return p.parseLogical(tokenAnd, "and", p.parseNot)
+}
+
+// parseLogical parses a chain of and or of or, both sides must be conditions.
+func (p *exprParser) parseLogical(kind tokenKind, op string, operand func() (*exprNode, error)) (*exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == kind {
+		tok := p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		for _, side := range []*exprNode{left, right} {
+			if err := expect(side, typeBool, op); err != nil {
+				return nil, err
+			}
+		}
+		left = &exprNode{kind: nodeBinary, typ: typeBool, pos: tok.pos, op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (*exprNode, error) {
+	if p.peek().kind != tokenNot {
+		return p.parseComparison()
+	}
+	tok := p.next()
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	if err := expect(operand, typeBool, "not"); err != nil {
+		return nil, err
+	}
+	return &exprNode{kind: nodeUnary, typ: typeBool, pos: tok.pos, op: "not", left: operand}, nil
+}
+
+func (p *exprParser) parseComparison() (*exprNode, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	switch tok.text {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	for _, side := range []*exprNode{left, right} {
+		if err := expect(side, typeNumber, tok.text); err != nil {
+			return nil, err
+		}
+	}
+	if next := p.peek(); next.kind == tokenOp && strings.ContainsAny(next.text, "<>=!") {
+		return nil, errorAt(next.pos, "comparisons cannot be chained, combine them with and")
+	}
+	return &exprNode{kind: nodeBinary, typ: typeBool, pos: tok.pos, op: tok.text, left: left, right: right}, nil
+}
+
+func (p *exprParser) parseSum() (*exprNode, error) {
+	return p.parseArithmetic("+-", p.parseProduct)
+}
+
+func (p *exprParser) parseProduct() (*exprNode, error) {
+	return p.parseArithmetic("*/", p.parseUnary)
+}
+
+// parseArithmetic parses a left associative chain of the operators in ops over numbers.
+func (p *exprParser) parseArithmetic(ops string, operand func() (*exprNode, error)) (*exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokenOp && len(tok.text) == 1 && strings.Contains(ops, tok.text); tok = p.peek() {
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		for _, side := range []*exprNode{left, right} {
+			if err := expect(side, typeNumber, tok.text); err != nil {
+				return nil, err
+			}
+		}
+		left = &exprNode{kind: nodeBinary, typ: typeNumber, pos: tok.pos, op: tok.text, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	if tok := p.peek(); tok.kind == tokenOp && tok.text == "-" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := expect(operand, typeNumber, "-"); err != nil {
+			return nil, err
+		}
+		return &exprNode{kind: nodeUnary, typ: typeNumber, pos: tok.pos, op: "-", left: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenNumber:
+		return &exprNode{kind: nodeNumber, typ: typeNumber, pos: tok.pos, num: tok.num}, nil
+	case tokenDuration:
+		return &exprNode{kind: nodeDuration, typ: typeDuration, pos: tok.pos, dur: tok.dur}, nil
+	case tokenLParen:
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, errorAt(closing.pos, "expected ) to close the ( at offset %d, got %s", tok.pos, describe(closing))
+		}
+		return inner, nil
+	case tokenPath:
+		if p.peek().kind == tokenLParen {
+			return p.parseCall(tok)
+		}
+		path, err := parseMetricPath(tok.text)
+		if err != nil {
+			e := err.(*exprError)
+			return nil, errorAt(tok.pos+e.pos, "%s", e.msg)
+		}
+		return &exprNode{kind: nodeMetric, typ: typeNumber, pos: tok.pos, path: path}, nil
+	}
+	return nil, errorAt(tok.pos, "expected a number, a metric or a function, got %s", describe(tok))
+}
+
+// parseCall parses a function call whose name was just read, checking its arguments against its signature.
+func (p *exprParser) parseCall(name token) (*exprNode, error) {
+	fn, ok := exprFunctions[name.text]
+	if !ok {
+		known := make([]string, 0, len(exprFunctions))
+		for n := range exprFunctions {
+			known = append(known, n)
+		}
+		sort.Strings(known)
+		return nil, errorAt(name.pos, "unknown function %s, expected one of %s", name.text, strings.Join(known, ", "))
+	}
+	p.next() // (
+
+	args := make([]*exprNode, 0)
+	for p.peek().kind != tokenRParen {
+		if len(args) > 0 {
+			if comma := p.next(); comma.kind != tokenComma {
+				return nil, errorAt(comma.pos, "expected , or ) in the arguments of %s, got %s", name.text, describe(comma))
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	closing := p.next()
+
+	if len(args) != fn.durations+1 {
+		return nil, errorAt(closing.pos, "%s takes %d arguments, got %d", name.text, fn.durations+1, len(args))
+	}
+	if args[0].kind != nodeMetric {
+		return nil, errorAt(args[0].pos, "the first argument of %s must be a metric path", name.text)
+	}
+	for _, arg := range args[1:] {
+		if err := expect(arg, typeDuration, name.text); err != nil {
+			return nil, err
+		}
+	}
+	if args[1].dur <= 0 {
+		return nil, errorAt(args[1].pos, "the window of %s must be longer than zero", name.text)
+	}
+	if args[1].dur > MetricsHistoryRetention {
+		return nil, errorAt(args[1].pos, "the window of %s is longer than the %s of metrics history kept", name.text, MetricsHistoryRetention)
+	}
+	return &exprNode{kind: nodeCall, typ: typeNumber, pos: name.pos, fn: name.text, args: args}, nil
+}
+
+// alertExpr is a compiled rule expression with the metrics whose history it looks at.
+type alertExpr struct {
+	text    string
+	root    *exprNode
+	history map[string]metricPath
+	window  time.Duration // longest window of its functions
+}
+
+// compileAlertExpr parses an expression that must be a condition, errors are *exprError with the offset.
+func compileAlertExpr(text string) (*alertExpr, error) {
+	tokens, err := lexExpr(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 1 {
+		return nil, errorAt(0, "expression is empty")
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, errorAt(tok.pos, "unexpected %s", describe(tok))
+	}
+	if root.typ != typeBool {
+		return nil, errorAt(root.pos, "expression must be a condition such as cpu.usage > 90, it is %s", valueTypeNames[root.typ])
+	}
+
+	expr := &alertExpr{text: text, root: root, history: make(map[string]metricPath)}
+	var walk func(node *exprNode)
+	walk = func(node *exprNode) {
+		if node == nil {
+			return
+		}
+		if node.kind == nodeCall {
+			expr.history[node.args[0].path.text] = node.args[0].path
+			if node.args[1].dur > expr.window {
+				expr.window = node.args[1].dur
+			}
+		}
+		for _, child := range append([]*exprNode{node.left, node.right}, node.args...) {
+			walk(child)
+		}
+	}
+	walk(root)
+	return expr, nil
+}
+
+// exprValue is the result of a node: a number or a truth. A comparison also keeps its two sides, the left
+// one is the value of the alert and the right one its threshold.
+type exprValue struct {
+	num       float64
+	truth     bool
+	threshold float64
+}
+
+// evalContext is what an expression is evaluated against.
+type evalContext struct {
+	tree map[string]interface{}
+	now  time.Time
+}
+
+func (n *exprNode) eval(ctx *evalContext) (exprValue, error) {
+	switch n.kind {
+	case nodeNumber:
+		return exprValue{num: n.num}, nil
+	case nodeMetric:
+		v, err := n.path.resolve(ctx.tree)
+		return exprValue{num: v}, err
+	case nodeCall:
+		fn := exprFunctions[n.fn]
+		window := n.args[1].dur
+		samples := metricHistory(n.args[0].path.text, ctx.now.Add(-window), ctx.now)
+		if len(samples) < fn.minSamples {
+			return exprValue{}, fmt.Errorf("%s: not enough history of %s yet, %d samples in the last %s", n.fn, n.args[0].path.text, len(samples), window)
+		}
+		durations := make([]time.Duration, 0, len(n.args)-1)
+		for _, arg := range n.args[1:] {
+			durations = append(durations, arg.dur)
+		}
+		return exprValue{num: fn.eval(samples, ctx.now, durations)}, nil
+	case nodeUnary:
+		v, err := n.left.eval(ctx)
+		if n.op == "-" {
+			v.num = -v.num
+		} else {
+			v.truth = !v.truth
+		}
+		return v, err
+	}
+
+	if n.op == "and" || n.op == "or" {
+		return n.evalLogical(ctx)
+	}
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return exprValue{}, err
+	}
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return exprValue{}, err
+	}
+
+	a, b := left.num, right.num
+	switch n.op {
+	case "+":
+		return exprValue{num: a + b}, nil
+	case "-":
+		return exprValue{num: a - b}, nil
+	case "*":
+		return exprValue{num: a * b}, nil
+	case "/":
+		if b == 0 {
+			return exprValue{}, fmt.Errorf("division by zero at offset %d", n.pos)
+		}
+		return exprValue{num: a / b}, nil
+	}
+	compared := exprValue{num: a, threshold: b}
+	switch n.op {
+	case ">":
+		compared.truth = a > b
+	case ">=":
+		compared.truth = a >= b
+	case "<":
+		compared.truth = a < b
+	case "<=":
+		compared.truth = a <= b
+	case "==":
+		compared.truth = a == b
+	case "!=":
+		compared.truth = a != b
+	}
+	return compared, nil
+}
+
+// evalLogical evaluates and and or. A side that decides the result on its own, false for and or true for or,
+// wins even when the other side cannot be evaluated, so a missing metric only fails what it would change.
+// The value of the decisive side is kept, the left one first, like the value of the alert.
+func (n *exprNode) evalLogical(ctx *evalContext) (exprValue, error) {
+	decisive := n.op == "or"
+	left, leftErr := n.left.eval(ctx)
+	if leftErr == nil && left.truth == decisive {
+		return left, nil
+	}
+	right, rightErr := n.right.eval(ctx)
+	if rightErr == nil && right.truth == decisive {
+		return right, nil
+	}
+	if leftErr != nil {
+		return exprValue{}, leftErr
+	}
+	return right, rightErr
+}
+
+// evaluate tells if the expression holds, with the value and threshold of the comparison that decided it.
+func (e *alertExpr) evaluate(tree map[string]interface{}, now time.Time) (bool, exprValue, error) {
+	v, err := e.root.eval(&evalContext{tree: tree, now: now})
+	if err != nil {
+		return false, exprValue{}, err
+	}
+	return v.truth, v, nil
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileAlertExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+		want string
+	}{
+		{"", 0, "expression is empty"},
+		{"cpu.usage", 0, "must be a condition"},
+		{"cpu.usage + 1", 10, "must be a condition"},
+		{"cpu.usage > ", 12, "expected a number, a metric or a function"},
+		{"cpu.usage >> 3", 11, "expected a number, a metric or a function"},
+		{"cpu.usage = 3", 10, "use == to compare"},
+		{"cpu.usage > 1 & 2", 14, "did you mean &&"},
+		{"cpu.usage > 1 and 3", 18, "and needs a condition, got a number"},
+		{"not cpu.usage", 4, "not needs a condition"},
+		{"1 < 2 < 3", 6, "cannot be chained"},
+		{"(cpu.usage > 1", 14, "expected ) to close the ( at offset 0"},
+		{"cpu.usage > 1)", 13, `unexpected ")"`},
+		{"cpu.usage > 1 $", 14, "unexpected character"},
+		{"disk[/var.used > 1", 4, "unclosed ["},
+		{"cpu..usage > 1", 4, "expected a field name"},
+		{"foo(cpu.usage) > 1", 0, "unknown function foo"},
+		{"rate(cpu.usage) > 1", 14, "rate takes 2 arguments, got 1"},
+		{"predict_linear(cpu.usage, 1h) > 1", 28, "predict_linear takes 3 arguments, got 2"},
+		{"rate(1, 5m) > 0", 5, "first argument of rate must be a metric path"},
+		{"rate(cpu.usage, 5) > 0", 16, "rate needs a duration, got a number"},
+		{"rate(cpu.usage, 5x) > 0", 17, `unknown duration unit "x"`},
+		{"rate(cpu.usage, 0s) > 0", 16, "must be longer than zero"},
+		{"rate(cpu.usage, 7h) > 0", 16, "longer than the 6h0m0s of metrics history kept"},
+		{"rate(cpu.usage 5m) > 0", 15, "expected , or ) in the arguments of rate"},
+		{"cpu.usage > 5m", 12, "> needs a number, got a duration"},
+	}
+	for _, tt := range tests {
+		_, err := compileAlertExpr(tt.expr)
+		e, ok := err.(*exprError)
+		if !ok {
+			t.Errorf("compileAlertExpr(%q) = %v, want an *exprError", tt.expr, err)
+			continue
+		}
+		if e.pos != tt.pos || !strings.Contains(e.msg, tt.want) {
+			t.Errorf("compileAlertExpr(%q) = offset %d %q, want offset %d %q", tt.expr, e.pos, e.msg, tt.pos, tt.want)
+		}
+	}
+}
+
+// evalExpr compiles and evaluates an expression that has to compile.
+func evalExpr(t *testing.T, text string, tree map[string]interface{}, now time.Time) (bool, exprValue, error) {
+	t.Helper()
+	expr, err := compileAlertExpr(text)
+	if err != nil {
+		t.Fatalf("compileAlertExpr(%q): %v", text, err)
+	}
+	return expr.evaluate(tree, now)
+}
+
+func TestAlertExprPrecedence(t *testing.T) {
+	tree := map[string]interface{}{"a": 2.0, "b": 3.0, "c": 4.0, "disk": []interface{}{
+		map[string]interface{}{"mountpoint": "/var", "used": 10.0},
+	}}
+	tests := []struct {
+		expr      string
+		holds     bool
+		value     float64
+		threshold float64
+	}{
+		{"a + b * c == 14", true, 14, 14},
+		{"(a + b) * c == 20", true, 20, 20},
+		{"a - b - c == -5", true, -5, -5},
+		{"c / a / a == 1", true, 1, 1},
+		{"-a * b == -6", true, -6, -6},
+		{"- -a == 2", true, 2, 2},
+		{"1.5 * a > .5", true, 3, 0.5},
+		{"disk[/var].used >= a * 5", true, 10, 10},
+		{"a > 1 and b > 5 or c > 3", true, 4, 3},
+		{"a > 1 or b > 5 and c > 5", true, 2, 1},
+		{"(a > 1 or b > 5) and c > 5", false, 4, 5},
+		{"not a > 1 or c > 3", true, 4, 3},
+		{"not (a > 1 or c > 3)", false, 2, 1},
+		{"a > 1 && !(b > 5) || c > 9", true, 3, 5},
+		{"a >= 2 and a <= 2 and a == 2 and a != 3", true, 2, 3},
+		{"a > 5 and b > 1", false, 2, 5},
+		{"a > 5 or b > 1", true, 3, 1},
+		{"a > 5 AND b > 1", false, 2, 5},
+	}
+	for _, tt := range tests {
+		holds, v, err := evalExpr(t, tt.expr, tree, time.Now())
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if holds != tt.holds || v.num != tt.value || v.threshold != tt.threshold {
+			t.Errorf("%q = %v value %g threshold %g, want %v value %g threshold %g",
+				tt.expr, holds, v.num, v.threshold, tt.holds, tt.value, tt.threshold)
+		}
+	}
+}
+
+// setHistory replaces the metrics history for a test.
+func setHistory(t *testing.T, series map[string][]metricSample) {
+	t.Helper()
+	metricsHistory.Lock()
+	saved := metricsHistory.series
+	metricsHistory.series = series
+	metricsHistory.Unlock()
+	t.Cleanup(func() {
+		metricsHistory.Lock()
+		metricsHistory.series = saved
+		metricsHistory.Unlock()
+	})
+}
+
+func TestAlertExprRangeFunctions(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	// one sample every 10s over the last 50s
+	series := func(values ...float64) []metricSample {
+		samples := make([]metricSample, len(values))
+		for i, v := range values {
+			samples[i] = metricSample{t: now.Add(time.Duration(i-len(values)+1) * 10 * time.Second), v: v}
+		}
+		return samples
+	}
+	setHistory(t, map[string][]metricSample{
+		"gauge":   series(1, 2, 3, 4, 5, 6),
+		"counter": series(1, 2, 3, 0, 1, 2),
+		"single":  series(7),
+	})
+
+	tests := []struct {
+		expr  string
+		value float64
+	}{
+		{"avg_over_time(gauge, 1m) > 0", 3.5},
+		{"max_over_time(gauge, 1m) > 0", 6},
+		{"min_over_time(gauge, 1m) > 0", 1},
+		{"delta(gauge, 1m) > 0", 5},
+		{"rate(gauge, 1m) > 0", 0.1},
+		{"rate(counter, 1m) > 0", 4.0 / 50},
+		{"predict_linear(gauge, 1m, 10s) > 0", 7},
+		{"predict_linear(gauge, 1m, 1m) > 0", 12},
+		{"predict_linear(gauge, 1m, 0s) > 0", 6},
+		// the window ends at now: only the samples at -10s and 0s are in 15s
+		{"avg_over_time(gauge, 15s) > 0", 5.5},
+		{"delta(gauge, 15s) > 0", 1},
+		{"avg_over_time(single, 1m) > 0", 7},
+		{"avg_over_time(gauge, 1m) - min_over_time(gauge, 1m) > 0", 2.5},
+	}
+	for _, tt := range tests {
+		_, v, err := evalExpr(t, tt.expr, nil, now)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if math.Abs(v.num-tt.value) > 1e-9 {
+			t.Errorf("%q = %g, want %g", tt.expr, v.num, tt.value)
+		}
+	}
+
+	// functions needing two samples, or looking at a window or a path without any
+	for _, expr := range []string{
+		"delta(single, 1m) > 0",
+		"rate(single, 1m) > 0",
+		"predict_linear(single, 1m, 1h) > 0",
+		"delta(gauge, 5s) > 0",
+		"avg_over_time(unknown, 1m) > 0",
+	} {
+		_, _, err := evalExpr(t, expr, nil, now)
+		if err == nil || !strings.Contains(err.Error(), "not enough history") {
+			t.Errorf("%q = %v, want a not enough history error", expr, err)
+		}
+	}
+}
+
+func TestAlertExprErrorPropagation(t *testing.T) {
+	tree := map[string]interface{}{"a": 2.0, "b": 3.0}
+	tests := []struct {
+		expr    string
+		holds   bool
+		wantErr string
+	}{
+		{"missing > 1", false, "no field missing"},
+		{"missing > 1 or a > 1", true, ""},
+		{"a > 1 or missing > 1", true, ""},
+		{"missing > 1 or a > 5", false, "no field missing"},
+		{"a > 5 or missing > 1", false, "no field missing"},
+		{"missing > 1 and a > 5", false, ""},
+		{"a > 5 and missing > 1", false, ""},
+		{"missing > 1 and a > 1", false, "no field missing"},
+		{"a > 1 and missing > 1", false, "no field missing"},
+		{"missing > 1 or other > 1", false, "no field missing"},
+		{"not missing > 1", false, "no field missing"},
+		{"(missing > 1 and a > 5) or b > 1", true, ""},
+		{"a + missing > 1 or b > 1", true, ""},
+		{"a / (b - b) > 1", false, "division by zero"},
+		{"a / (b - b) > 1 or b > 1", true, ""},
+	}
+	for _, tt := range tests {
+		holds, _, err := evalExpr(t, tt.expr, tree, time.Now())
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%q: unexpected error %v", tt.expr, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%q = %v, want an error containing %q", tt.expr, err, tt.wantErr)
+		case holds != tt.holds:
+			t.Errorf("%q = %v, want %v", tt.expr, holds, tt.holds)
+		}
+	}
+}
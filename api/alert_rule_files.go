@@ -0,0 +1,278 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ruleFileError is a problem at a line and column of a rule file, both are left out when unknown.
+type ruleFileError struct {
+	file   string
+	line   int
+	column int
+	msg    string
+}
+
+func (e *ruleFileError) Error() string {
+	switch {
+	case e.line == 0:
+		return fmt.Sprintf("%s: %s", e.file, e.msg)
+	case e.column == 0:
+		return fmt.Sprintf("%s:%d: %s", e.file, e.line, e.msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.file, e.line, e.column, e.msg)
+}
+
+// yamlErrorLine matches the syntax errors of the YAML parser, which only know the line
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// ruleFile is a rule file being loaded, it collects every problem rather than stopping at the first one.
+type ruleFile struct {
+	path     string
+	source   []byte
+	problems []error
+}
+
+func (f *ruleFile) problemAt(line, column int, format string, args ...interface{}) {
+	f.problems = append(f.problems, &ruleFileError{file: f.path, line: line, column: column, msg: fmt.Sprintf(format, args...)})
+}
+
+func (f *ruleFile) problem(node *yaml.Node, format string, args ...interface{}) {
+	f.problemAt(node.Line, node.Column, format, args...)
+}
+
+// scalar returns the text of a single value such as a name or an expression.
+func (f *ruleFile) scalar(node *yaml.Node, field string) (string, bool) {
+	if node.Kind != yaml.ScalarNode {
+		f.problem(node, "%s must be a single value", field)
+		return "", false
+	}
+	return node.Value, true
+}
+
+// stringMap returns the labels or annotations of a rule.
+func (f *ruleFile) stringMap(node *yaml.Node, field string) map[string]string {
+	if node.Kind != yaml.MappingNode {
+		f.problem(node, "%s must be a mapping of names to values", field)
+		return nil
+	}
+	values := make(map[string]string, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if _, ok := values[key.Value]; ok {
+			f.problem(key, "%s %s is set twice", field, key.Value)
+			continue
+		}
+		if text, ok := f.scalar(value, field+" "+key.Value); ok {
+			values[key.Value] = text
+		}
+	}
+	return values
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// exprPosition finds the line and column of a byte offset of the value of a scalar node. The value and the
+// source are walked together, a run of whitespace matching any other, so an expression folded over several
+// lines or written as a block still points at the right character.
+func (f *ruleFile) exprPosition(node *yaml.Node, offset int) (int, int) {
+	line, i := 1, 0
+	for i < len(f.source) && line < node.Line {
+		if f.source[i] == '\n' {
+			line++
+		}
+		i++
+	}
+	i += node.Column - 1
+	switch node.Style {
+	case yaml.DoubleQuotedStyle, yaml.SingleQuotedStyle:
+		i++
+	case yaml.LiteralStyle, yaml.FoldedStyle:
+		// the value starts on the line after the | or >
+		for i < len(f.source) && f.source[i] != '\n' {
+			i++
+		}
+		for i < len(f.source) && isSpace(f.source[i]) {
+			i++
+		}
+	}
+
+	value := node.Value
+	for j := 0; j < offset && j < len(value) && i < len(f.source); {
+		if isSpace(value[j]) {
+			for j < len(value) && isSpace(value[j]) {
+				j++
+			}
+			for i < len(f.source) && isSpace(f.source[i]) {
+				i++
+			}
+			continue
+		}
+		// escapes of quoted values make the source longer, keep going character by character
+		i++
+		j++
+	}
+
+	line, column := 1, 1
+	for _, c := range f.source[:min(i, len(f.source))] {
+		if c == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
+
+// decodeRule reads a rule from its node, checks it and compiles its expression and annotation templates.
+func (f *ruleFile) decodeRule(node *yaml.Node) *AlertRule {
+	if node.Kind != yaml.MappingNode {
+		f.problem(node, "a rule must be a mapping with name and expr")
+		return nil
+	}
+	before := len(f.problems)
+	rule := &AlertRule{File: f.path, line: node.Line, column: node.Column}
+	fields := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if _, ok := fields[key.Value]; ok {
+			f.problem(key, "%s is set twice", key.Value)
+			continue
+		}
+		fields[key.Value] = value
+		switch key.Value {
+		case "name":
+			rule.Name, _ = f.scalar(value, "name")
+		case "expr":
+			rule.Expr, _ = f.scalar(value, "expr")
+		case "for":
+			rule.For, _ = f.scalar(value, "for")
+		case "labels":
+			rule.Labels = f.stringMap(value, "labels")
+		case "annotations":
+			rule.Annotations = f.stringMap(value, "annotations")
+		default:
+			f.problem(key, "unknown field %s, a rule has name, expr, for, labels and annotations", key.Value)
+		}
+	}
+
+	if fields["name"] == nil {
+		f.problem(node, "rule has no name")
+	} else if rule.Name == "" {
+		f.problem(fields["name"], "rule has no name")
+	}
+
+	if fields["expr"] == nil {
+		f.problem(node, "rule %s has no expr", rule.Name)
+	} else if fields["expr"].Kind == yaml.ScalarNode {
+		expr, err := compileAlertExpr(rule.Expr)
+		if err != nil {
+			e := err.(*exprError)
+			line, column := f.exprPosition(fields["expr"], e.pos)
+			f.problemAt(line, column, "%s", e.msg)
+		}
+		rule.expr = expr
+	}
+
+	if rule.For != "" {
+		var err error
+		if rule.forDuration, err = time.ParseDuration(rule.For); err != nil || rule.forDuration < 0 {
+			f.problem(fields["for"], "invalid for duration %q, expected a duration such as 5m", rule.For)
+		}
+	}
+
+	rule.templates = make(map[string]*template.Template)
+	if value := fields["annotations"]; value != nil && value.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			name, text := value.Content[i].Value, value.Content[i+1]
+			tmpl, err := template.New(name).Option("missingkey=zero").Parse(text.Value)
+			if err == nil {
+				// a template using a field that does not exist fails here rather than on every evaluation
+				err = tmpl.Execute(&bytes.Buffer{}, alertTemplateData{Labels: rule.Labels})
+			}
+			if err != nil {
+				f.problem(text, "annotation %s: %v", name, err)
+				continue
+			}
+			rule.templates[name] = tmpl
+		}
+	}
+
+	if len(f.problems) > before {
+		return nil
+	}
+	return rule
+}
+
+// loadAlertRuleFile reads the rules of a file, the problems found are returned with their line and column
+// and the rules only when there are none. JSON files are read the same way, JSON being YAML.
+func loadAlertRuleFile(path string) ([]*AlertRule, []error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []error{err}
+	}
+	f := &ruleFile{path: path, source: data}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+			line, _ := strconv.Atoi(match[1])
+			f.problemAt(line, 0, "%s", match[2])
+		} else {
+			f.problemAt(0, 0, "%v", err)
+		}
+		return nil, f.problems
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		f.problem(root, "expected a mapping with a rules list")
+		return nil, f.problems
+	}
+	rules := make([]*AlertRule, 0)
+	names := make(map[string]*AlertRule)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if key.Value != "rules" {
+			f.problem(key, "unknown field %s, expected rules", key.Value)
+			continue
+		}
+		if value.Kind != yaml.SequenceNode {
+			f.problem(value, "rules must be a list")
+			continue
+		}
+		for _, node := range value.Content {
+			rule := f.decodeRule(node)
+			if rule == nil {
+				continue
+			}
+			if other, ok := names[rule.Name]; ok {
+				f.problem(node, "rule %s is already defined at line %d", rule.Name, other.line)
+				continue
+			}
+			names[rule.Name] = rule
+			rules = append(rules, rule)
+		}
+	}
+	if len(f.problems) > 0 {
+		sort.SliceStable(f.problems, func(i, j int) bool {
+			a, b := f.problems[i].(*ruleFileError), f.problems[j].(*ruleFileError)
+			return a.line < b.line || a.line == b.line && a.column < b.column
+		})
+		return nil, f.problems
+	}
+	return rules, nil
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadAlertRuleFilePositions(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"plain", `
+rules:
+  - name: A
+    expr: avg_over_time(cpu.usage, 5m) >> 3
+`, []string{":4:41: expected a number"}},
+		{"double quoted", `
+rules:
+  - name: A
+    expr: "rate(cpu.usage, 1m) + 1"
+`, []string{":4:32: expression must be a condition"}},
+		{"single quoted", `
+rules:
+  - name: A
+    expr: 'cpu.usage > foo(x)'
+`, []string{":4:24: unknown function foo"}},
+		{"folded", `
+rules:
+  - name: A
+    expr: >
+      memory.used > memory.total
+      and foo(cpu.usage)
+`, []string{":6:11: unknown function foo"}},
+		{"literal", `
+rules:
+  - name: A
+    expr: |
+      memory.used > 1
+        and delta(memory.used, 10x) > 0
+`, []string{":6:34: unknown duration unit"}},
+		{"plain over two lines", `
+rules:
+  - name: A
+    expr: memory.used > 1 and
+      rate(memory.used) > 0
+`, []string{":5:23: rate takes 2 arguments"}},
+		{"fields", `
+rules:
+  - name: A
+    expr: cpu.usage > 1
+    for: soon
+    bogus: 1
+    labels: [a]
+  - expr: cpu.usage > 1
+  - name: A
+    expr: cpu.usage > 2
+    annotations:
+      summary: "{{ .Nope }}"
+groups: []
+`, []string{
+			":5:10: invalid for duration",
+			":6:5: unknown field bogus",
+			":7:13: labels must be a mapping",
+			":8:5: rule has no name",
+			":12:16: annotation summary",
+			":13:1: unknown field groups",
+		}},
+		{"duplicate names", `
+rules:
+  - name: A
+    expr: cpu.usage > 1
+  - name: A
+    expr: cpu.usage > 2
+`, []string{":5:5: rule A is already defined at line 3"}},
+		{"syntax", `
+rules:
+  - name: A
+   expr: [
+`, []string{".yaml:"}},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")+".yaml")
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rules, errs := loadAlertRuleFile(path)
+		if rules != nil {
+			t.Errorf("%s: loaded %d rules from a file with problems", tt.name, len(rules))
+		}
+		if len(errs) != len(tt.want) {
+			t.Errorf("%s: got %d problems %v, want %d", tt.name, len(errs), errs, len(tt.want))
+			continue
+		}
+		for i, err := range errs {
+			if got := err.Error(); !strings.HasPrefix(got, path) || !strings.Contains(got, tt.want[i]) {
+				t.Errorf("%s: problem %d = %q, want %s%s", tt.name, i, got, path, tt.want[i])
+			}
+		}
+	}
+}
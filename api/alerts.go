@@ -0,0 +1,284 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// AlertState is where an alert is between its condition turning true and turning false again.
+type AlertState string
+
+const (
+	ALERT_STATE_PENDING  AlertState = "pending"  // the condition holds but not for the for duration yet
+	ALERT_STATE_FIRING   AlertState = "firing"   // the condition held for the whole for duration
+	ALERT_STATE_RESOLVED AlertState = "resolved" // the condition stopped holding after the alert fired
+)
+
+// AlertRuleDir holds the alert rule files, YAML (or JSON) files with a list of rules each.
+var AlertRuleDir = "alerts.d"
+
+// AlertResolvedRetention is how long a resolved alert stays listed.
+var AlertResolvedRetention = 15 * time.Minute
+
+// ErrInvalidAlertRules is returned when a rule file cannot be loaded, the rules in use are kept
+var ErrInvalidAlertRules = errors.New("invalid alert rules")
+
+// AlertRule raises an alert when its expression holds for the for duration, the labels and annotations are
+// copied to the alert. Annotations are templates of the alert value: {{ .Value }}, {{ .Labels.severity }}.
+// The value and threshold are the left and right sides of the comparison that decided the expression.
+type AlertRule struct {
+	Name        string            `json:"name"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for,omitempty"` // such as 5m, the alert fires at once when empty
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	File           string    `json:"file"` // filled in when the rule is read
+	LastEvaluation time.Time `json:"last_evaluation"`
+	LastValue      *float64  `json:"last_value,omitempty"`
+	LastError      string    `json:"last_error,omitempty"` // why the expression could not be evaluated, like a missing metric
+
+	expr        *alertExpr
+	forDuration time.Duration
+	templates   map[string]*template.Template
+	line        int // where the rule starts in its file
+	column      int
+}
+
+// Alert is the current state of the alert of a rule.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	State       AlertState        `json:"state"`
+	Expr        string            `json:"expr"`
+	Value       float64           `json:"value"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	ActiveAt    time.Time         `json:"active_at"` // when the condition started to hold
+	FiredAt     time.Time         `json:"fired_at"`
+	ResolvedAt  time.Time         `json:"resolved_at"`
+}
+
+// alertTemplateData is what the annotation templates can use
+type alertTemplateData struct {
+	Value     float64
+	Threshold float64
+	Labels    map[string]string
+}
+
+// alerts holds the loaded rules, the metrics their functions keep a history of and the alert of every rule
+// whose condition held
+var alerts = struct {
+	sync.RWMutex
+	rules   []*AlertRule
+	history map[string]metricPath
+	active  map[string]*Alert
+}{active: make(map[string]*Alert)}
+
+// LoadAlertRules reads every rule file of AlertRuleDir and replaces the rules in use. Every problem is
+// reported with its file, line and column, and when there is one nothing is replaced. Alerts of rules that
+// are kept go on where they were.
+func LoadAlertRules() ([]AlertRule, error) {
+	rules := make([]*AlertRule, 0)
+	problems := make([]string, 0)
+
+	entries, err := os.ReadDir(AlertRuleDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		problems = append(problems, err.Error())
+	}
+	names := make(map[string]*AlertRule)
+	history := make(map[string]metricPath)
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		path := filepath.Join(AlertRuleDir, entry.Name())
+		fileRules, errs := loadAlertRuleFile(path)
+		for _, err := range errs {
+			problems = append(problems, err.Error())
+		}
+		for _, rule := range fileRules {
+			if other, ok := names[rule.Name]; ok {
+				problems = append(problems, fmt.Sprintf("%s:%d:%d: rule %s is already defined in %s:%d",
+					path, rule.line, rule.column, rule.Name, other.File, other.line))
+				continue
+			}
+			names[rule.Name] = rule
+			rules = append(rules, rule)
+			for text, metric := range rule.expr.history {
+				history[text] = metric
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAlertRules, strings.Join(problems, "; "))
+	}
+
+	alerts.Lock()
+	alerts.rules = rules
+	alerts.history = history
+	for name := range alerts.active {
+		if _, ok := names[name]; !ok {
+			delete(alerts.active, name)
+		}
+	}
+	alerts.Unlock()
+
+	log.Printf("Loaded %d alert rules from %s", len(rules), AlertRuleDir)
+	return ListAlertRules(), nil
+}
+
+// notifyAlert posts a state change of an alert to the notification webhook when one is configured.
+func notifyAlert(alert *Alert) {
+	if NotificationWebhookURL == "" {
+		return
+	}
+	message := alert.Annotations["summary"]
+	if message == "" {
+		message = fmt.Sprintf("%s is %g", alert.Expr, alert.Value)
+	}
+	n := Notification{
+		Time:    time.Now(),
+		Source:  "alert:" + alert.Rule,
+		Title:   fmt.Sprintf("[%s] %s", strings.ToUpper(string(alert.State)), alert.Rule),
+		Message: message,
+		Labels:  alert.Labels,
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := sendNotification(ctx, NotificationWebhookURL, n); err != nil {
+			log.Printf("Error notifying alert %s: %v", n.Source, err)
+		}
+	}()
+}
+
+// renderAnnotations fills in the annotation templates of a rule for the current value.
+func (rule *AlertRule) renderAnnotations(alert *Alert, threshold float64) {
+	data := alertTemplateData{Value: alert.Value, Threshold: threshold, Labels: alert.Labels}
+	alert.Annotations = make(map[string]string, len(rule.templates))
+	for name, tmpl := range rule.templates {
+		var text bytes.Buffer
+		if err := tmpl.Execute(&text, data); err != nil {
+			text.Reset()
+			text.WriteString(rule.Annotations[name])
+		}
+		alert.Annotations[name] = text.String()
+	}
+}
+
+// EvaluateAlerts records the metrics the rules keep a history of, then checks every rule against freshly
+// collected metrics and moves the alerts along their states. A rule whose metric is missing, or without enough
+// history for its functions yet, counts as not holding.
+func EvaluateAlerts(metrics Metrics, now time.Time) {
+	tree, err := metricsTree(metrics)
+	if err != nil {
+		log.Printf("Error preparing metrics for the alert rules: %v", err)
+		return
+	}
+
+	alerts.Lock()
+	defer alerts.Unlock()
+
+	recordMetricsHistory(tree, alerts.history, now)
+	for _, rule := range alerts.rules {
+		holds, result, err := rule.expr.evaluate(tree, now)
+		value := result.num
+		rule.LastEvaluation = now
+		rule.LastError = ""
+		rule.LastValue = nil
+		if err != nil {
+			rule.LastError = err.Error()
+		} else {
+			rule.LastValue = &value
+		}
+
+		alert := alerts.active[rule.Name]
+		if holds {
+			if alert == nil || alert.State == ALERT_STATE_RESOLVED {
+				labels := map[string]string{"alertname": rule.Name}
+				for k, v := range rule.Labels {
+					labels[k] = v
+				}
+				alert = &Alert{Rule: rule.Name, State: ALERT_STATE_PENDING, Expr: rule.Expr, Labels: labels, ActiveAt: now}
+				alerts.active[rule.Name] = alert
+			}
+			alert.Value = value
+			rule.renderAnnotations(alert, result.threshold)
+			if alert.State == ALERT_STATE_PENDING && now.Sub(alert.ActiveAt) >= rule.forDuration {
+				alert.State = ALERT_STATE_FIRING
+				alert.FiredAt = now
+				log.Printf("Alert %s firing, %s is %g", rule.Name, rule.Expr, value)
+				notifyAlert(alert)
+			}
+			continue
+		}
+
+		if alert == nil {
+			continue
+		}
+		switch alert.State {
+		case ALERT_STATE_PENDING:
+			delete(alerts.active, rule.Name)
+		case ALERT_STATE_FIRING:
+			alert.State = ALERT_STATE_RESOLVED
+			alert.ResolvedAt = now
+			if err == nil {
+				alert.Value = value
+			}
+			log.Printf("Alert %s resolved", rule.Name)
+			notifyAlert(alert)
+		case ALERT_STATE_RESOLVED:
+			if now.Sub(alert.ResolvedAt) > AlertResolvedRetention {
+				delete(alerts.active, rule.Name)
+			}
+		}
+	}
+}
+
+// alertOrder lists firing alerts first, then pending and resolved ones
+var alertOrder = map[AlertState]int{ALERT_STATE_FIRING: 0, ALERT_STATE_PENDING: 1, ALERT_STATE_RESOLVED: 2}
+
+// ListAlerts returns the pending and firing alerts, and the recently resolved ones when includeResolved is set.
+func ListAlerts(includeResolved bool) []Alert {
+	alerts.RLock()
+	defer alerts.RUnlock()
+
+	list := make([]Alert, 0, len(alerts.active))
+	for _, alert := range alerts.active {
+		if alert.State == ALERT_STATE_RESOLVED && !includeResolved {
+			continue
+		}
+		list = append(list, *alert)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].State != list[j].State {
+			return alertOrder[list[i].State] < alertOrder[list[j].State]
+		}
+		return list[i].Rule < list[j].Rule
+	})
+	return list
+}
+
+// ListAlertRules returns copies of the loaded rules with the outcome of their last evaluation.
+func ListAlertRules() []AlertRule {
+	alerts.RLock()
+	defer alerts.RUnlock()
+
+	list := make([]AlertRule, 0, len(alerts.rules))
+	for _, rule := range alerts.rules {
+		list = append(list, *rule)
+	}
+	return list
+}
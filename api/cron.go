@@ -0,0 +1,218 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed 5 field cron expression, every field is a bit set of the values it allows.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	domStar, dowStar bool // a field starting with * does not restrict the day, see dayMatches
+	loc              *time.Location
+}
+
+// cronField describes the range and the names of one field.
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+// cronMacros are the @ shortcuts and the expression they stand for
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a cron expression evaluated in the named time zone, the local one when zone is empty.
+func parseCron(expr, zone string) (*cronSchedule, error) {
+	loc := time.Local
+	if zone != "" {
+		var err error
+		if loc, err = time.LoadLocation(zone); err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", zone)
+		}
+	}
+
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@") {
+		expanded, ok := cronMacros[strings.ToLower(expr)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cron macro %s", expr)
+		}
+		expr = expanded
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, it has %d", expr, len(fields))
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+
+	// 7 is another name for sunday
+	if sets[4]&(1<<7) != 0 {
+		sets[4] = sets[4]&^(1<<7) | 1
+	}
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+		loc:     loc,
+	}, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps such as 1,5-10,*/15.
+func parseCronField(text string, field cronField) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(text, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field %q", field.name, text)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		low, high := field.min, field.max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = cronValue(bounds[0], field); err != nil {
+				return 0, err
+			}
+			if high, err = cronValue(bounds[1], field); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("range %s of %s field is backwards", rangePart, field.name)
+			}
+		default:
+			value, err := cronValue(rangePart, field)
+			if err != nil {
+				return 0, err
+			}
+			low = value
+			// a single value with a step runs to the end of the range, like 5/15
+			if step == 1 {
+				high = value
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// cronValue reads one number or name of a field and checks its range.
+func cronValue(text string, field cronField) (int, error) {
+	if v, ok := field.names[strings.ToLower(text)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q in %s field", text, field.name)
+	}
+	if v < field.min || v > field.max {
+		return 0, fmt.Errorf("value %d of %s field is out of range %d-%d", v, field.name, field.min, field.max)
+	}
+	return v, nil
+}
+
+// dayMatches follows cron: when both day fields are restricted a day matching either of them counts.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// cronMaxSteps bounds the search of next, far more than any schedule needs to reach its limit
+const cronMaxSteps = 100000
+
+// next returns the first time strictly after after that matches the schedule, or the zero time when there is
+// none within five years (like February 30). Wall clock times skipped by daylight saving time never match,
+// wall clock times repeated when it ends match both times.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for step := 0; step < cronMaxSteps && t.Before(limit); step++ {
+		year, month, day := t.Date()
+		var n time.Time
+		switch {
+		case c.month&(1<<uint(month)) == 0:
+			n = time.Date(year, month+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			n = time.Date(year, month, day+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			n = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, c.loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			n = t.Add(time.Minute)
+		case !t.After(after):
+			// a wall clock that repeats at the end of daylight saving time can land before after
+			n = t.Add(time.Minute)
+		default:
+			return t
+		}
+		// time.Date moves a wall clock skipped by daylight saving time back before the gap, such as 02:00 to
+		// 01:00, go to the start of the next real hour instead
+		if !n.After(t) {
+			n = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+		}
+		t = n
+	}
+	return time.Time{}
+}
+
+// upcoming returns the next n times of the schedule after from.
+func (c *cronSchedule) upcoming(from time.Time, n int) []time.Time {
+	times := make([]time.Time, 0, n)
+	for len(times) < n {
+		from = c.next(from)
+		if from.IsZero() {
+			break
+		}
+		times = append(times, from)
+	}
+	return times
+}
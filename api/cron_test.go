@@ -0,0 +1,135 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expr, zone, want string
+	}{
+		{"* * * *", "", "must have 5 fields"},
+		{"* * * * * *", "", "must have 5 fields"},
+		{"60 * * * *", "", "out of range 0-59"},
+		{"* 24 * * *", "", "out of range 0-23"},
+		{"* * 0 * *", "", "out of range 1-31"},
+		{"* * * 13 *", "", "out of range 1-12"},
+		{"* * * * 8", "", "out of range 0-7"},
+		{"*/0 * * * *", "", "invalid step"},
+		{"*/x * * * *", "", "invalid step"},
+		{"10-5 * * * *", "", "is backwards"},
+		{"* * * foo *", "", "invalid value"},
+		{"@often", "", "unknown cron macro"},
+		{"* * * * *", "Mars/Olympus", "unknown time zone"},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.expr, tt.zone)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseCron(%q, %q) = %v, want an error containing %q", tt.expr, tt.zone, err, tt.want)
+		}
+	}
+}
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s not available: %v", name, err)
+	}
+	return loc
+}
+
+func TestCronNext(t *testing.T) {
+	utc := time.UTC
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"every minute", "* * * * *", time.Date(2026, 1, 1, 10, 0, 30, 0, utc), time.Date(2026, 1, 1, 10, 1, 0, 0, utc)},
+		{"strictly after", "0 10 * * *", time.Date(2026, 1, 1, 10, 0, 0, 0, utc), time.Date(2026, 1, 2, 10, 0, 0, 0, utc)},
+		{"step", "*/15 * * * *", time.Date(2026, 1, 1, 10, 16, 0, 0, utc), time.Date(2026, 1, 1, 10, 30, 0, 0, utc)},
+		{"hour rollover", "5 * * * *", time.Date(2026, 1, 1, 23, 30, 0, 0, utc), time.Date(2026, 1, 2, 0, 5, 0, 0, utc)},
+		{"month rollover", "0 0 1 * *", time.Date(2026, 1, 31, 12, 0, 0, 0, utc), time.Date(2026, 2, 1, 0, 0, 0, 0, utc)},
+		{"year rollover", "0 0 1 1 *", time.Date(2026, 12, 31, 23, 59, 0, 0, utc), time.Date(2027, 1, 1, 0, 0, 0, 0, utc)},
+		{"31st skips short months", "0 0 31 * *", time.Date(2026, 4, 1, 0, 0, 0, 0, utc), time.Date(2026, 5, 31, 0, 0, 0, 0, utc)},
+		{"leap day", "0 0 29 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, utc), time.Date(2028, 2, 29, 0, 0, 0, 0, utc)},
+		{"never", "0 0 30 2 *", time.Date(2026, 1, 1, 0, 0, 0, 0, utc), time.Time{}},
+		// 2026-01-01 is a thursday: the 15th or any monday, whichever comes first
+		{"dom or dow", "0 0 15 * mon", time.Date(2026, 1, 1, 0, 0, 0, 0, utc), time.Date(2026, 1, 5, 0, 0, 0, 0, utc)},
+		{"dom or dow, dom first", "0 0 3 * mon", time.Date(2026, 1, 1, 0, 0, 0, 0, utc), time.Date(2026, 1, 3, 0, 0, 0, 0, utc)},
+		{"dow star restricts nothing", "0 0 15 * *", time.Date(2026, 1, 1, 0, 0, 0, 0, utc), time.Date(2026, 1, 15, 0, 0, 0, 0, utc)},
+		{"dom star and dow", "0 0 * * 1-5", time.Date(2026, 1, 2, 12, 0, 0, 0, utc), time.Date(2026, 1, 5, 0, 0, 0, 0, utc)},
+		{"sunday as 7", "0 0 * * 7", time.Date(2026, 1, 1, 0, 0, 0, 0, utc), time.Date(2026, 1, 4, 0, 0, 0, 0, utc)},
+		{"macro", "@monthly", time.Date(2026, 1, 15, 0, 0, 0, 0, utc), time.Date(2026, 2, 1, 0, 0, 0, 0, utc)},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr, "UTC")
+		if err != nil {
+			t.Fatalf("%s: parseCron(%q): %v", tt.name, tt.expr, err)
+		}
+		if got := c.next(tt.after); !got.Equal(tt.want) {
+			t.Errorf("%s: next(%v) of %q = %v, want %v", tt.name, tt.after, tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCronNextDaylightSaving(t *testing.T) {
+	ny := loadLocation(t, "America/New_York")
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  []time.Time
+	}{
+		// 2026-03-08 02:00 to 02:59 does not exist in New York, the run of that day is skipped
+		{"spring forward gap", "0 2 * * *", time.Date(2026, 3, 8, 0, 30, 0, 0, ny), []time.Time{
+			time.Date(2026, 3, 9, 2, 0, 0, 0, ny),
+			time.Date(2026, 3, 10, 2, 0, 0, 0, ny),
+		}},
+		{"spring forward gap minutes", "30 2 * * *", time.Date(2026, 3, 7, 12, 0, 0, 0, ny), []time.Time{
+			time.Date(2026, 3, 9, 2, 30, 0, 0, ny),
+			time.Date(2026, 3, 10, 2, 30, 0, 0, ny),
+		}},
+		{"spring forward around the gap", "*/30 * * * *", time.Date(2026, 3, 8, 1, 15, 0, 0, ny), []time.Time{
+			time.Date(2026, 3, 8, 1, 30, 0, 0, ny),
+			time.Date(2026, 3, 8, 3, 0, 0, 0, ny),
+		}},
+		// 2026-11-01 01:00 to 01:59 happens twice in New York, first in EDT then in EST
+		{"fall back repeated hour", "30 1 * * *", time.Date(2026, 11, 1, 0, 0, 0, 0, ny), []time.Time{
+			time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC),
+			time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC),
+			time.Date(2026, 11, 2, 6, 30, 0, 0, time.UTC),
+		}},
+		{"fall back hourly", "0 * * * *", time.Date(2026, 11, 1, 0, 30, 0, 0, ny), []time.Time{
+			time.Date(2026, 11, 1, 5, 0, 0, 0, time.UTC),
+			time.Date(2026, 11, 1, 6, 0, 0, 0, time.UTC),
+			time.Date(2026, 11, 1, 7, 0, 0, 0, time.UTC),
+		}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr, "America/New_York")
+		if err != nil {
+			t.Fatalf("%s: parseCron(%q): %v", tt.name, tt.expr, err)
+		}
+		done := make(chan []time.Time, 1)
+		go func() { done <- c.upcoming(tt.after, len(tt.want)) }()
+		var got []time.Time
+		select {
+		case got = <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: upcoming of %q did not return", tt.name, tt.expr)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: upcoming of %q = %v, want %v", tt.name, tt.expr, got, tt.want)
+		}
+		for i := range got {
+			if !got[i].Equal(tt.want[i]) {
+				t.Errorf("%s: run %d of %q = %v, want %v", tt.name, i, tt.expr, got[i], tt.want[i].In(ny))
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kinds of edge between two services
+const (
+	DEPENDENCY_REQUIRES = "requires" // the dependency is started first and has to be running
+	DEPENDENCY_AFTER    = "after"    // ordering only, applied when both services are started together
+)
+
+// how long a start or stop waits for a dependency to settle
+const dependencyTimeout = 2 * time.Minute
+
+// ServiceGraph is the dependency graph of the installed services as rendered by the dashboard.
+type ServiceGraph struct {
+	Nodes []ServiceGraphNode `json:"nodes"`
+	Edges []ServiceGraphEdge `json:"edges"`
+}
+
+type ServiceGraphNode struct {
+	Name   string        `json:"name"`
+	Status ServiceStatus `json:"status"`
+	Health ServiceHealth `json:"health"`
+}
+
+// ServiceGraphEdge points from a service to the service it depends on.
+type ServiceGraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Type string `json:"type"`
+}
+
+// dependenciesOf returns every service name spec has to be ordered after.
+func dependenciesOf(spec ServiceSpec) []string {
+	return append(append([]string{}, spec.Requires...), spec.After...)
+}
+
+// findCycle returns the services forming a cycle in specs, or nil when the graph is acyclic.
+func findCycle(specs map[string]ServiceSpec) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var stack []string
+	var cycle []string
+
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case visiting:
+			for i, n := range stack {
+				if n == name {
+					cycle = append(append([]string{}, stack[i:]...), name)
+				}
+			}
+			return true
+		case done:
+			return false
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range dependenciesOf(specs[name]) {
+			if visit(dep) {
+				return true
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+		return false
+	}
+
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if visit(name) {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// validateDependencies rejects a spec that would close a dependency cycle with the installed services,
+// must be called with the store lock held.
+func validateDependencies(spec ServiceSpec) error {
+	specs := make(map[string]ServiceSpec, len(serviceList.services)+1)
+	for name, service := range serviceList.services {
+		specs[name] = service.Spec
+	}
+	specs[spec.Name] = spec
+
+	for _, dep := range dependenciesOf(spec) {
+		if dep == spec.Name {
+			return fmt.Errorf("service %s cannot depend on itself", spec.Name)
+		}
+	}
+	if cycle := findCycle(specs); cycle != nil {
+		return fmt.Errorf("service %s would create a dependency cycle: %s", spec.Name, strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// orderServices sorts names so that every service comes after the ones it requires or is ordered after,
+// must be called with the store lock held.
+func orderServices(names map[string]bool) []string {
+	visited := make(map[string]bool)
+	order := make([]string, 0, len(names))
+
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		if service, ok := serviceList.services[name]; ok {
+			deps := dependenciesOf(service.Spec)
+			sort.Strings(deps)
+			for _, dep := range deps {
+				if names[dep] {
+					visit(dep)
+				}
+			}
+		}
+		order = append(order, name)
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		visit(name)
+	}
+	return order
+}
+
+// requiredServices returns the services name requires, directly or not, in the order they have to be started.
+// Must be called with the store lock held.
+func requiredServices(name string) ([]string, error) {
+	closure := make(map[string]bool)
+
+	var collect func(name string) error
+	collect = func(name string) error {
+		service, ok := serviceList.services[name]
+		if !ok {
+			return fmt.Errorf("required service %s is not installed", name)
+		}
+		for _, dep := range service.Spec.Requires {
+			if closure[dep] {
+				continue
+			}
+			closure[dep] = true
+			if err := collect(dep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := collect(name); err != nil {
+		return nil, err
+	}
+	return orderServices(closure), nil
+}
+
+// ErrServiceRequired is returned when a service cannot be uninstalled because others require it, the HTTP layer maps
+// it to 409 Conflict
+var ErrServiceRequired = errors.New("service is required by other services")
+
+// directDependents returns the services listing name in their requires, leaving out the ones being uninstalled.
+// Must be called with the store lock held.
+func directDependents(name string) []string {
+	dependents := make([]string, 0)
+	for other, service := range serviceList.services {
+		if service.Operation == SERVICE_ACTION_UNINSTALL {
+			continue
+		}
+		for _, dep := range service.Spec.Requires {
+			if dep == name {
+				dependents = append(dependents, other)
+				break
+			}
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// dependentServices returns the services requiring name, directly or not, in the order they have to be stopped.
+// Must be called with the store lock held.
+func dependentServices(name string) []string {
+	closure := make(map[string]bool)
+
+	var collect func(name string)
+	collect = func(name string) {
+		for other, service := range serviceList.services {
+			if closure[other] {
+				continue
+			}
+			for _, dep := range service.Spec.Requires {
+				if dep == name {
+					closure[other] = true
+					collect(other)
+					break
+				}
+			}
+		}
+	}
+	collect(name)
+
+	order := orderServices(closure)
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order
+}
+
+// waitSettled polls a service until no operation is in flight and returns its final state.
+func waitSettled(name string) (ServiceInfo, error) {
+	deadline := time.Now().Add(dependencyTimeout)
+	for {
+		service, err := GetServiceStatus(name)
+		if err != nil {
+			return service, err
+		}
+		if service.Operation == "" {
+			return service, nil
+		}
+		if time.Now().After(deadline) {
+			return service, fmt.Errorf("%w: service %s is still %s after %s", ErrServiceBusy, name, service.Operation, dependencyTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// viaActor names the actor of a start or stop cascading from the operation in flight on service.
+func viaActor(service *ServiceInfo) string {
+	serviceList.RLock()
+	defer serviceList.RUnlock()
+	return fmt.Sprintf("%s (via %s)", service.opActor, service.Name)
+}
+
+// startDependencies brings up every required service in order before the start of service goes through.
+func startDependencies(service *ServiceInfo, deps []string) {
+	for _, dep := range deps {
+		info, err := GetServiceStatus(dep)
+		if err == nil && info.Status != SERVICE_STATUS_STARTED {
+			// a dependency already on its way up is simply waited for
+			if startErr := Start(dep, viaActor(service)); startErr != nil && !errors.Is(startErr, ErrServiceBusy) {
+				err = startErr
+			} else {
+				info, err = waitSettled(dep)
+			}
+		}
+		if err == nil && info.Status != SERVICE_STATUS_STARTED {
+			err = fmt.Errorf("required service %s is %s", dep, info.Status)
+		}
+		if err != nil {
+			serviceList.Lock()
+			service.LastExitReason = fmt.Sprintf("dependency failed: %v", err)
+			failOperation(service, SERVICE_STATUS_FAILED, errors.New(service.LastExitReason))
+			serviceList.Unlock()
+			serviceLogf(service.Name, "not started, dependency failed: %v", err)
+			return
+		}
+	}
+
+	serviceList.Lock()
+	defer serviceList.Unlock()
+	performStart(service)
+}
+
+// stopDependents stops every service requiring this one, deepest first, before the stop of service goes through.
+func stopDependents(service *ServiceInfo, dependents []string) {
+	for _, dep := range dependents {
+		// a cascaded stop leaves the dependent wanted running, it comes back with this service or at boot
+		if err := stopRequested(dep, viaActor(service), false); err == nil || errors.Is(err, ErrServiceBusy) {
+			waitSettled(dep)
+		}
+	}
+
+	serviceList.Lock()
+	defer serviceList.Unlock()
+	performStop(service)
+}
+
+// runningDependents returns the started services requiring name, directly or not, in the order they have to be
+// started again. Must be called with the store lock held.
+func runningDependents(name string) []string {
+	running := make(map[string]bool)
+	for _, dep := range dependentServices(name) {
+		if serviceList.services[dep].Status == SERVICE_STATUS_STARTED {
+			running[dep] = true
+		}
+	}
+	return orderServices(running)
+}
+
+// startDependents waits for name to be back up and starts again the dependents its stop took down, in order.
+func startDependents(name string, dependents []string, actor string) {
+	if len(dependents) == 0 {
+		return
+	}
+	info, err := waitSettled(name)
+	if err == nil && info.Status != SERVICE_STATUS_STARTED {
+		err = fmt.Errorf("service %s is %s", name, info.Status)
+	}
+	if err != nil {
+		serviceLogf(name, "dependents %s not started again: %v", strings.Join(dependents, ", "), err)
+		return
+	}
+	for _, dep := range dependents {
+		if err := Start(dep, fmt.Sprintf("%s (via %s)", actor, name)); err != nil && !errors.Is(err, ErrInvalidTransition) {
+			serviceLogf(dep, "not started again after %s: %v", name, err)
+			continue
+		}
+		waitSettled(dep)
+	}
+}
+
+// GetServiceGraph returns the installed services with their dependency edges.
+func GetServiceGraph() ServiceGraph {
+	serviceList.RLock()
+	defer serviceList.RUnlock()
+
+	graph := ServiceGraph{Nodes: make([]ServiceGraphNode, 0), Edges: make([]ServiceGraphEdge, 0)}
+	all := make(map[string]bool, len(serviceList.services))
+	for name := range serviceList.services {
+		all[name] = true
+	}
+	for _, name := range orderServices(all) {
+		service := serviceList.services[name]
+		graph.Nodes = append(graph.Nodes, ServiceGraphNode{Name: name, Status: service.Status, Health: service.Health})
+		for _, dep := range service.Spec.Requires {
+			graph.Edges = append(graph.Edges, ServiceGraphEdge{From: name, To: dep, Type: DEPENDENCY_REQUIRES})
+		}
+		for _, dep := range service.Spec.After {
+			graph.Edges = append(graph.Edges, ServiceGraphEdge{From: name, To: dep, Type: DEPENDENCY_AFTER})
+		}
+	}
+	return graph
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"time"
+)
+
+// ServiceHealth is the result of the health checks, kept apart from the lifecycle status.
+type ServiceHealth string
+
+const (
+	SERVICE_HEALTH_UNKNOWN   ServiceHealth = "UNKNOWN"
+	SERVICE_HEALTH_HEALTHY   ServiceHealth = "HEALTHY"
+	SERVICE_HEALTH_UNHEALTHY ServiceHealth = "UNHEALTHY"
+)
+
+// kinds of health check a service can declare
+const (
+	HEALTH_CHECK_HTTP = "http"
+	HEALTH_CHECK_TCP  = "tcp"
+	HEALTH_CHECK_EXEC = "exec"
+)
+
+// defaults used when a health check leaves its timing empty
+const (
+	defaultHealthInterval           = 10 * time.Second
+	defaultHealthTimeout            = 5 * time.Second
+	defaultHealthHealthyThreshold   = 1
+	defaultHealthUnhealthyThreshold = 3
+)
+
+// HealthCheckSpec declares how the health of a running service is probed.
+type HealthCheckSpec struct {
+	Type string `json:"type"` // http, tcp or exec
+
+	URL          string `json:"url,omitempty"`           // http: address to GET
+	ExpectStatus int    `json:"expect_status,omitempty"` // http: expected status code, defaults to 200
+	BodyRegex    string `json:"body_regex,omitempty"`    // http: the body must match it when set
+
+	Address string `json:"address,omitempty"` // tcp: host:port to connect to
+
+	Command        string   `json:"command,omitempty"` // exec: program to run
+	Args           []string `json:"args,omitempty"`
+	ExpectExitCode int      `json:"expect_exit_code,omitempty"`
+
+	Interval           int  `json:"interval,omitempty"`            // seconds between checks
+	Timeout            int  `json:"timeout,omitempty"`             // seconds a single check may take
+	HealthyThreshold   int  `json:"healthy_threshold,omitempty"`   // consecutive successes to become HEALTHY
+	UnhealthyThreshold int  `json:"unhealthy_threshold,omitempty"` // consecutive failures to become UNHEALTHY
+	RestartOnUnhealthy bool `json:"restart_on_unhealthy,omitempty"`
+}
+
+// healthMonitor is the probing loop of one service, closing stop ends it.
+type healthMonitor struct {
+	stop      chan struct{}
+	successes int
+	failures  int
+}
+
+// validateHealthCheck rejects incomplete checks before the service is registered.
+func validateHealthCheck(name string, check *HealthCheckSpec) error {
+	if check == nil {
+		return nil
+	}
+	switch check.Type {
+	case HEALTH_CHECK_HTTP:
+		if check.URL == "" {
+			return fmt.Errorf("http health check for service %s needs an url", name)
+		}
+		if _, err := regexp.Compile(check.BodyRegex); err != nil {
+			return fmt.Errorf("body regex of the health check for service %s: %v", name, err)
+		}
+	case HEALTH_CHECK_TCP:
+		if _, _, err := net.SplitHostPort(check.Address); err != nil {
+			return fmt.Errorf("tcp health check for service %s needs a host:port address: %v", name, err)
+		}
+	case HEALTH_CHECK_EXEC:
+		if _, err := exec.LookPath(check.Command); err != nil {
+			return fmt.Errorf("health check command %q for service %s cannot be found: %v", check.Command, name, err)
+		}
+	default:
+		return fmt.Errorf("health check type %q for service %s must be one of http, tcp or exec", check.Type, name)
+	}
+	if check.Interval < 0 || check.Timeout < 0 || check.HealthyThreshold < 0 || check.UnhealthyThreshold < 0 {
+		return fmt.Errorf("health check settings for service %s cannot be negative", name)
+	}
+	return nil
+}
+
+// healthSettings fills the check timing with its defaults.
+func healthSettings(check *HealthCheckSpec) (interval, timeout time.Duration, healthy, unhealthy int) {
+	interval, timeout = defaultHealthInterval, defaultHealthTimeout
+	healthy, unhealthy = defaultHealthHealthyThreshold, defaultHealthUnhealthyThreshold
+	if check.Interval > 0 {
+		interval = time.Duration(check.Interval) * time.Second
+	}
+	if check.Timeout > 0 {
+		timeout = time.Duration(check.Timeout) * time.Second
+	}
+	if check.HealthyThreshold > 0 {
+		healthy = check.HealthyThreshold
+	}
+	if check.UnhealthyThreshold > 0 {
+		unhealthy = check.UnhealthyThreshold
+	}
+	return
+}
+
+// runHealthCheck probes the service once, a nil error means the check passed.
+func runHealthCheck(check *HealthCheckSpec, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch check.Type {
+	case HEALTH_CHECK_HTTP:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		expected := check.ExpectStatus
+		if expected == 0 {
+			expected = http.StatusOK
+		}
+		if resp.StatusCode != expected {
+			return fmt.Errorf("got status %d, expected %d", resp.StatusCode, expected)
+		}
+		if check.BodyRegex != "" {
+			body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+			if err != nil {
+				return err
+			}
+			if !regexp.MustCompile(check.BodyRegex).Match(body) {
+				return fmt.Errorf("body does not match %q", check.BodyRegex)
+			}
+		}
+		return nil
+
+	case HEALTH_CHECK_TCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", check.Address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case HEALTH_CHECK_EXEC:
+		err := exec.CommandContext(ctx, check.Command, check.Args...).Run()
+		code := 0
+		if err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || ctx.Err() != nil {
+				return err
+			}
+			code = exitErr.ExitCode()
+		}
+		if code != check.ExpectExitCode {
+			return fmt.Errorf("exited with code %d, expected %d", code, check.ExpectExitCode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown health check type %q", check.Type)
+}
+
+// startHealthMonitor starts probing the service when it declares a check, must be called with the store lock held.
+func startHealthMonitor(service *ServiceInfo) {
+	service.Health = SERVICE_HEALTH_UNKNOWN
+	if service.Spec.HealthCheck == nil || service.health != nil {
+		return
+	}
+	monitor := &healthMonitor{stop: make(chan struct{})}
+	service.health = monitor
+	go monitorHealth(service, monitor, service.Spec.HealthCheck)
+}
+
+// stopHealthMonitor ends the probing loop of the service, must be called with the store lock held.
+func stopHealthMonitor(service *ServiceInfo) {
+	if service.health != nil {
+		close(service.health.stop)
+		service.health = nil
+	}
+}
+
+// monitorHealth runs the check of a service on its interval while the service is STARTED.
+func monitorHealth(service *ServiceInfo, monitor *healthMonitor, check *HealthCheckSpec) {
+	interval, timeout, healthy, unhealthy := healthSettings(check)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-monitor.stop:
+			return
+		case <-ticker.C:
+		}
+
+		serviceList.RLock()
+		running := service.Status == SERVICE_STATUS_STARTED
+		serviceList.RUnlock()
+
+		if !running {
+			serviceList.Lock()
+			monitor.successes, monitor.failures = 0, 0
+			service.Health = SERVICE_HEALTH_UNKNOWN
+			serviceList.Unlock()
+			continue
+		}
+
+		err := runHealthCheck(check, timeout)
+
+		serviceList.Lock()
+		if service.health != monitor {
+			serviceList.Unlock()
+			return
+		}
+		service.LastHealthCheck = time.Now()
+		if err != nil {
+			monitor.successes = 0
+			monitor.failures++
+			service.HealthMessage = err.Error()
+		} else {
+			monitor.failures = 0
+			monitor.successes++
+			service.HealthMessage = ""
+		}
+
+		restart := false
+		switch {
+		case monitor.successes >= healthy && service.Health != SERVICE_HEALTH_HEALTHY:
+			service.Health = SERVICE_HEALTH_HEALTHY
+			serviceLogf(service.Name, "health check passing")
+		case monitor.failures >= unhealthy && service.Health != SERVICE_HEALTH_UNHEALTHY:
+			service.Health = SERVICE_HEALTH_UNHEALTHY
+			serviceLogf(service.Name, "health check failing: %s", service.HealthMessage)
+			restart = check.RestartOnUnhealthy
+		}
+		name := service.Name
+		serviceList.Unlock()
+
+		if restart {
+			log.Printf("Service %s is unhealthy, restarting it", name)
+			if err := Restart(name, ACTOR_HEALTH_CHECK); err != nil {
+				log.Printf("Restarting unhealthy service %s failed: %v", name, err)
+			}
+
+			// judge the new process on its own checks
+			serviceList.Lock()
+			monitor.successes, monitor.failures = 0, 0
+			service.Health = SERVICE_HEALTH_UNKNOWN
+			serviceList.Unlock()
+		}
+	}
+}
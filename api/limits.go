@@ -0,0 +1,316 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// CgroupRoot is the mount point of the cgroup v2 hierarchy, every supervised service with limits
+// gets its own child group below CgroupRoot/server-monitor when the panel runs with privileges.
+var CgroupRoot = "/sys/fs/cgroup"
+
+const (
+	cgroupParent = "server-monitor"
+	cpuPeriod    = 100000 // microseconds, the default period of cpu.max
+)
+
+// ResourceLimits caps what a supervised service may use. Without cgroups only nofile, nice and an address
+// space limit standing in for memory_max can be enforced per service, through rlimits.
+type ResourceLimits struct {
+	CPUQuota  float64 `json:"cpu_quota,omitempty"`  // percent of one core, 150 allows one and a half cores
+	MemoryMax int64   `json:"memory_max,omitempty"` // bytes
+	// PidsMax is only per service with cgroups. Without them it falls back to RLIMIT_NPROC, which counts every
+	// process of the user the service runs as, other services of that user included, and does nothing for root.
+	PidsMax int64  `json:"pids_max,omitempty"`
+	Nofile  uint64 `json:"nofile,omitempty"`
+	Nice    int    `json:"nice,omitempty"`
+}
+
+// limitCounters are the cgroup counters telling that a limit was hit, compared between two reads.
+type limitCounters struct {
+	oomKills  int64
+	throttled int64
+	pidsMax   int64
+}
+
+var (
+	cgroupOnce      sync.Once
+	cgroupSupported bool
+)
+
+// validateLimits rejects limits that cannot be applied.
+func validateLimits(name string, limits *ResourceLimits) error {
+	if limits == nil {
+		return nil
+	}
+	if limits.CPUQuota < 0 || limits.MemoryMax < 0 || limits.PidsMax < 0 {
+		return fmt.Errorf("resource limits for service %s cannot be negative", name)
+	}
+	if limits.Nice < -20 || limits.Nice > 19 {
+		return fmt.Errorf("nice for service %s must be between -20 and 19", name)
+	}
+	return nil
+}
+
+// cgroupsAvailable reports whether the panel can create cgroup v2 groups, it needs root and a unified hierarchy.
+func cgroupsAvailable() bool {
+	cgroupOnce.Do(func() {
+		if os.Geteuid() != 0 {
+			return
+		}
+		if _, err := os.Stat(filepath.Join(CgroupRoot, "cgroup.controllers")); err != nil {
+			return
+		}
+		cgroupSupported = true
+	})
+	return cgroupSupported
+}
+
+// needsCgroup tells if some of the limits can only be enforced by a cgroup.
+func needsCgroup(limits *ResourceLimits) bool {
+	return limits.CPUQuota > 0 || limits.MemoryMax > 0 || limits.PidsMax > 0
+}
+
+// writeCgroupFile writes a single value into a cgroup control file.
+func writeCgroupFile(dir, file, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("writing %s to %s: %v", value, filepath.Join(dir, file), err)
+	}
+	return nil
+}
+
+// prepareCgroup creates the group of a service with its limits and returns its path.
+func prepareCgroup(name string, limits *ResourceLimits) (string, error) {
+	parent := filepath.Join(CgroupRoot, cgroupParent)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return "", err
+	}
+
+	// controllers have to be handed down at every level before a child can use them
+	controllers := "+cpu +memory +pids"
+	if err := writeCgroupFile(CgroupRoot, "cgroup.subtree_control", controllers); err != nil {
+		return "", err
+	}
+	if err := writeCgroupFile(parent, "cgroup.subtree_control", controllers); err != nil {
+		return "", err
+	}
+
+	// names are validated at install, a group still never lands anywhere but right below the parent
+	dir := filepath.Join(parent, name)
+	if filepath.Dir(dir) != parent {
+		return "", fmt.Errorf("%w: service name %q is not usable as a cgroup name", ErrInvalidService, name)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	cpuMax := "max"
+	if limits.CPUQuota > 0 {
+		cpuMax = strconv.Itoa(int(limits.CPUQuota / 100 * cpuPeriod))
+	}
+	if err := writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%s %d", cpuMax, cpuPeriod)); err != nil {
+		return "", err
+	}
+	memoryMax := "max"
+	if limits.MemoryMax > 0 {
+		memoryMax = strconv.FormatInt(limits.MemoryMax, 10)
+	}
+	if err := writeCgroupFile(dir, "memory.max", memoryMax); err != nil {
+		return "", err
+	}
+	pidsMax := "max"
+	if limits.PidsMax > 0 {
+		pidsMax = strconv.FormatInt(limits.PidsMax, 10)
+	}
+	if err := writeCgroupFile(dir, "pids.max", pidsMax); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// removeCgroup deletes the group of a service once its processes are gone.
+func removeCgroup(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error removing cgroup %s: %v", dir, err)
+	}
+}
+
+// needsRlimits tells if some of the limits have to be set on the process itself.
+func needsRlimits(limits *ResourceLimits, inCgroup bool) bool {
+	return limits.Nofile > 0 || limits.Nice != 0 || (!inCgroup && (limits.MemoryMax > 0 || limits.PidsMax > 0))
+}
+
+// wrapWithLimits makes cmd start through the panel binary, which sets the rlimits and nice value on itself
+// before it execs the real program. Setting them from outside once the program runs would race with it.
+func wrapWithLimits(cmd *exec.Cmd, limits *ResourceLimits, inCgroup bool) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	args := []string{self, limitsHelperArg, string(encoded), strconv.FormatBool(inCgroup), cmd.Path}
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = self
+	return nil
+}
+
+// limitsHelperArg marks a panel process started by wrapWithLimits
+const limitsHelperArg = "__server-monitor-exec-with-limits"
+
+// RunLimitsHelper turns the process into the limits helper when it was started as one, it never returns then.
+// It has to be called first thing in main.
+func RunLimitsHelper() {
+	if len(os.Args) < 6 || os.Args[1] != limitsHelperArg {
+		return
+	}
+	var limits ResourceLimits
+	if err := json.Unmarshal([]byte(os.Args[2]), &limits); err != nil {
+		fmt.Fprintf(os.Stderr, "limits helper: decoding limits: %v\n", err)
+		os.Exit(127)
+	}
+	inCgroup, _ := strconv.ParseBool(os.Args[3])
+	path, argv := os.Args[4], os.Args[5:]
+
+	// a limit that cannot be set is reported on stderr, which ends up in the service log, the program still runs
+	for _, err := range setOwnLimits(&limits, inCgroup) {
+		fmt.Fprintf(os.Stderr, "limit not applied: %v\n", err)
+	}
+	err := syscall.Exec(path, argv, os.Environ())
+	fmt.Fprintf(os.Stderr, "limits helper: exec %s: %v\n", path, err)
+	os.Exit(127)
+}
+
+// setOwnLimits applies the per process limits to the calling process, memory and pids only when no cgroup
+// takes care of them.
+func setOwnLimits(limits *ResourceLimits, inCgroup bool) []error {
+	var errs []error
+	set := func(resource int, value uint64, label string) {
+		limit := &unix.Rlimit{Cur: value, Max: value}
+		if err := unix.Setrlimit(resource, limit); err != nil {
+			errs = append(errs, fmt.Errorf("setting %s to %d: %v", label, value, err))
+		}
+	}
+
+	if limits.Nofile > 0 {
+		set(unix.RLIMIT_NOFILE, limits.Nofile, "nofile")
+	}
+	if !inCgroup {
+		if limits.MemoryMax > 0 {
+			set(unix.RLIMIT_AS, uint64(limits.MemoryMax), "address space")
+		}
+		if limits.PidsMax > 0 {
+			set(unix.RLIMIT_NPROC, uint64(limits.PidsMax), "nproc")
+		}
+	}
+	if limits.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, limits.Nice); err != nil {
+			errs = append(errs, fmt.Errorf("setting nice to %d: %v", limits.Nice, err))
+		}
+	}
+	return errs
+}
+
+// readCgroupCounter returns the value of key in a flat keyed cgroup file such as memory.events.
+func readCgroupCounter(dir, file, key string) int64 {
+	f, err := os.Open(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			value, _ := strconv.ParseInt(fields[1], 10, 64)
+			return value
+		}
+	}
+	return 0
+}
+
+// readLimitCounters reads the counters of every limit of a group.
+func readLimitCounters(dir string) limitCounters {
+	return limitCounters{
+		oomKills:  readCgroupCounter(dir, "memory.events", "oom_kill"),
+		throttled: readCgroupCounter(dir, "cpu.stat", "nr_throttled"),
+		pidsMax:   readCgroupCounter(dir, "pids.events", "max"),
+	}
+}
+
+// reportLimitHits compares the counters of a running service with the previous read and reports what grew,
+// must be called with the store lock held.
+func reportLimitHits(service *ServiceInfo, current limitCounters) {
+	proc := service.proc
+	if proc == nil {
+		return
+	}
+	previous := proc.limits
+	limits := service.Spec.Limits
+	if limits == nil {
+		limits = &ResourceLimits{}
+	}
+
+	var hits []string
+	if n := current.oomKills - previous.oomKills; n > 0 {
+		hits = append(hits, fmt.Sprintf("%d process(es) killed by the OOM killer, memory_max %d", n, limits.MemoryMax))
+	}
+	if n := current.pidsMax - previous.pidsMax; n > 0 {
+		hits = append(hits, fmt.Sprintf("%d fork(s) refused by pids_max %d", n, limits.PidsMax))
+	}
+	// throttling goes on for as long as the service is busy, only its beginning is an event
+	throttled := current.throttled > previous.throttled
+	if throttled {
+		service.StatusReason = fmt.Sprintf("throttled by cpu_quota %.0f%%", limits.CPUQuota)
+		if !proc.throttling {
+			hits = append(hits, service.StatusReason)
+		}
+	}
+	proc.throttling = throttled
+	proc.limits = current
+
+	for _, hit := range hits {
+		service.StatusReason = hit
+		recordEvent(ServiceEvent{Service: service.Name, Actor: ACTOR_SUPERVISOR, From: service.Status, To: service.Status, Error: hit})
+	}
+}
+
+// checkLimitHits reads the cgroup counters of every running service with limits.
+func checkLimitHits() {
+	serviceList.RLock()
+	groups := make(map[string]string)
+	for name, service := range serviceList.services {
+		if service.proc != nil && service.proc.cgroup != "" {
+			groups[name] = service.proc.cgroup
+		}
+	}
+	serviceList.RUnlock()
+
+	for name, dir := range groups {
+		counters := readLimitCounters(dir)
+
+		serviceList.Lock()
+		if service, ok := serviceList.services[name]; ok && service.proc != nil && service.proc.cgroup == dir {
+			reportLimitHits(service, counters)
+		}
+		serviceList.Unlock()
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// metricKeyFields identify an entry of a metrics list in a path, like the mountpoint in disk[/var]
+var metricKeyFields = []string{"mountpoint", "name", "pid"}
+
+// pathSegment is one field of a metric path, with the key picking an entry of a list when keyed.
+type pathSegment struct {
+	field string
+	key   string
+	keyed bool
+}
+
+// metricPath is a parsed path to a number in the metrics, such as cpu.usage or disk[/var].used_percent.
+type metricPath struct {
+	text     string
+	segments []pathSegment
+}
+
+func (p metricPath) String() string {
+	return p.text
+}
+
+// isPathChar tells if c can be part of a field name.
+func isPathChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// parseMetricPath parses a path, the errors are *exprError with the offset of the problem in text.
+func parseMetricPath(text string) (metricPath, error) {
+	path := metricPath{text: text}
+	i := 0
+	for {
+		start := i
+		for i < len(text) && isPathChar(text[i]) {
+			i++
+		}
+		if i == start {
+			return path, errorAt(i, "expected a field name in %q", text)
+		}
+		segment := pathSegment{field: text[start:i]}
+
+		if i < len(text) && text[i] == '[' {
+			end := strings.IndexByte(text[i:], ']')
+			if end < 0 {
+				return path, errorAt(i, "unclosed [ in %q", text)
+			}
+			segment.key, segment.keyed = text[i+1:i+end], true
+			if segment.key == "" {
+				return path, errorAt(i, "empty key in %q", text)
+			}
+			i += end + 1
+		}
+		path.segments = append(path.segments, segment)
+
+		if i == len(text) {
+			return path, nil
+		}
+		if text[i] != '.' {
+			return path, errorAt(i, "unexpected %q in %q", text[i], text)
+		}
+		i++
+	}
+}
+
+// metricsTree turns the metrics into the generic tree the paths are resolved against.
+func metricsTree(metrics Metrics) (map[string]interface{}, error) {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	return tree, json.Unmarshal(data, &tree)
+}
+
+// matchesKey tells if an entry of a list is the one a key names.
+func matchesKey(entry interface{}, key string) bool {
+	fields, ok := entry.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, name := range metricKeyFields {
+		if value, ok := fields[name]; ok && fmt.Sprint(value) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// pickEntry finds the entry a key names in a list, or in the lists of an object such as disk.partitions.
+func pickEntry(node interface{}, key string) (interface{}, bool) {
+	switch v := node.(type) {
+	case []interface{}:
+		for _, entry := range v {
+			if matchesKey(entry, key) {
+				return entry, true
+			}
+		}
+	case map[string]interface{}:
+		for _, child := range v {
+			if list, ok := child.([]interface{}); ok {
+				if entry, ok := pickEntry(list, key); ok {
+					return entry, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// resolve returns the number a path points to in a metrics tree, booleans count as 0 and 1.
+func (p metricPath) resolve(tree map[string]interface{}) (float64, error) {
+	var node interface{} = tree
+	for _, segment := range p.segments {
+		fields, ok := node.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("metric %s: %s is not an object", p.text, segment.field)
+		}
+		if node, ok = fields[segment.field]; !ok {
+			return 0, fmt.Errorf("metric %s: no field %s", p.text, segment.field)
+		}
+		if segment.keyed {
+			if node, ok = pickEntry(node, segment.key); !ok {
+				return 0, fmt.Errorf("metric %s: nothing matches %s[%s]", p.text, segment.field, segment.key)
+			}
+		}
+	}
+
+	switch v := node.(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("metric %s is not a number", p.text)
+}
@@ -38,6 +38,18 @@ type MemoryStats struct { //Public struct (by pascal casing (Uppercase )) to exp
 }
 
 type DiskStats struct { //Public struct (by pascal casing (Uppercase )) to expose type variable information
+	Total       uint64           `json:"total"`
+	Free        uint64           `json:"free"`
+	Used        uint64           `json:"used"`
+	UsedPercent float64          `json:"used_percent"`
+	Partitions  []PartitionStats `json:"partitions"` // every mounted file system, the totals above are for /
+}
+
+// PartitionStats is the usage of one mounted file system.
+type PartitionStats struct {
+	Mountpoint  string  `json:"mountpoint"`
+	Device      string  `json:"device"`
+	Fstype      string  `json:"fstype"`
 	Total       uint64  `json:"total"`
 	Free        uint64  `json:"free"`
 	Used        uint64  `json:"used"`
@@ -116,12 +128,35 @@ func GetDiskStats() (DiskStats, error) {
 		return DiskStats{}, err
 	}
 
-	return DiskStats{
+	stats := DiskStats{
 		Total:       diskStat.Total,
 		Free:        diskStat.Free,
 		Used:        diskStat.Used,
 		UsedPercent: diskStat.UsedPercent,
-	}, nil
+		Partitions:  make([]PartitionStats, 0),
+	}
+
+	// a partition that cannot be read, like a stale network mount, is left out
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return stats, nil
+	}
+	for _, partition := range partitions {
+		usage, err := disk.Usage(partition.Mountpoint)
+		if err != nil {
+			continue
+		}
+		stats.Partitions = append(stats.Partitions, PartitionStats{
+			Mountpoint:  partition.Mountpoint,
+			Device:      partition.Device,
+			Fstype:      partition.Fstype,
+			Total:       usage.Total,
+			Free:        usage.Free,
+			Used:        usage.Used,
+			UsedPercent: usage.UsedPercent,
+		})
+	}
+	return stats, nil
 }
 
 // GetNetworkStats retrieves current bytes sent/received information ( public func or method using Camelcase!)
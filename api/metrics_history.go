@@ -0,0 +1,55 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MetricsHistoryRetention is the longest window the alert rule functions can look back at.
+var MetricsHistoryRetention = 6 * time.Hour
+
+// metricSample is the value of a metric at one metrics update.
+type metricSample struct {
+	t time.Time
+	v float64
+}
+
+// metricsHistory keeps the recent values of the metrics the alert rules look back at, by metric path
+var metricsHistory = struct {
+	sync.RWMutex
+	series map[string][]metricSample
+}{series: make(map[string][]metricSample)}
+
+// recordMetricsHistory appends the current value of every path to its series and forgets the samples older than
+// the retention, as well as the series of paths no rule uses anymore. A path missing from the metrics is skipped.
+func recordMetricsHistory(tree map[string]interface{}, paths map[string]metricPath, now time.Time) {
+	metricsHistory.Lock()
+	defer metricsHistory.Unlock()
+
+	for text := range metricsHistory.series {
+		if _, ok := paths[text]; !ok {
+			delete(metricsHistory.series, text)
+		}
+	}
+	oldest := now.Add(-MetricsHistoryRetention)
+	for text, path := range paths {
+		samples := metricsHistory.series[text]
+		if v, err := path.resolve(tree); err == nil {
+			samples = append(samples, metricSample{t: now, v: v})
+		}
+		keep := sort.Search(len(samples), func(i int) bool { return !samples[i].t.Before(oldest) })
+		metricsHistory.series[text] = samples[keep:]
+	}
+}
+
+// metricHistory returns the samples of a path taken from since to until, oldest first.
+func metricHistory(path string, since, until time.Time) []metricSample {
+	metricsHistory.RLock()
+	defer metricsHistory.RUnlock()
+
+	samples := metricsHistory.series[path]
+	from := sort.Search(len(samples), func(i int) bool { return !samples[i].t.Before(since) })
+	to := sort.Search(len(samples), func(i int) bool { return samples[i].t.After(until) })
+	return append([]metricSample(nil), samples[from:to]...)
+}
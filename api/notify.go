@@ -0,0 +1,51 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// NotificationWebhookURL receives the notifications that do not name their own URL, none are sent when empty.
+var NotificationWebhookURL = ""
+
+// NotificationTimeout bounds a webhook call, a task without a timeout of its own cannot hang on one.
+var NotificationTimeout = 10 * time.Second
+
+// Notification is the JSON body posted to a notification webhook.
+type Notification struct {
+	Time    time.Time         `json:"time"`
+	Source  string            `json:"source"` // what sent it, such as task:12
+	Title   string            `json:"title,omitempty"`
+	Message string            `json:"message"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// sendNotification posts a notification to url, any status other than 2xx is an error.
+func sendNotification(ctx context.Context, url string, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: NotificationTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s answered with status %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package api
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// OverlapPolicy decides what happens when a recurring task is due while its previous run is still going.
+type OverlapPolicy string
+
+const (
+	OVERLAP_SKIP  OverlapPolicy = "skip"  // drop the new run
+	OVERLAP_QUEUE OverlapPolicy = "queue" // start the new run once the previous one finished
+	OVERLAP_ALLOW OverlapPolicy = "allow" // run both at the same time
+)
+
+// ErrRecurringTaskExists is returned when a recurring task name is taken, the HTTP layer maps it to 409 Conflict
+var ErrRecurringTaskExists = errors.New("recurring task already exists")
+
+// RecurringTaskFile keeps the recurring task definitions across panel restarts.
+var RecurringTaskFile = filepath.Join("data", "recurring_tasks.json")
+
+// RecurringTask spawns a run of Task every time its cron schedule fires.
+type RecurringTask struct {
+	Name        string        `json:"name"`
+	Schedule    string        `json:"schedule"`            // 5 field cron expression or a macro such as @hourly
+	TimeZone    string        `json:"time_zone,omitempty"` // IANA name, the panel time zone when empty
+	Overlap     OverlapPolicy `json:"overlap,omitempty"`   // defaults to skip
+	Task        TaskSpec      `json:"task"`
+	CreatedTime time.Time     `json:"created_time"`
+
+	NextRun time.Time `json:"next_run"` // filled in when the definition is read
+	Running int       `json:"running"`
+	Waiting int       `json:"waiting"` // runs held back by the queue overlap policy
+
+	schedule *cronSchedule
+	running  int
+	waiting  []*Task
+}
+
+// snapshot copies a definition with its live counters, must be called with the store lock held.
+func (r *RecurringTask) snapshot() RecurringTask {
+	copied := RecurringTask{
+		Name:        r.Name,
+		Schedule:    r.Schedule,
+		TimeZone:    r.TimeZone,
+		Overlap:     r.Overlap,
+		Task:        r.Task,
+		CreatedTime: r.CreatedTime,
+		Running:     r.running,
+		Waiting:     len(r.waiting),
+	}
+	for _, task := range tasks.queue {
+		if task.RecurringTask == r.Name {
+			copied.NextRun = task.RunTime
+		}
+	}
+	return copied
+}
+
+// validateRecurringTask checks a definition and parses its schedule.
+func validateRecurringTask(def *RecurringTask) error {
+	if def.Name == "" {
+		return fmt.Errorf("%w: recurring task name cannot be empty", ErrInvalidTask)
+	}
+	// the name would be shadowed by the GET /api/recurring-tasks/preview route
+	if def.Name == "preview" {
+		return fmt.Errorf("%w: recurring task name %q is reserved", ErrInvalidTask, def.Name)
+	}
+	switch def.Overlap {
+	case "":
+		def.Overlap = OVERLAP_SKIP
+	case OVERLAP_SKIP, OVERLAP_QUEUE, OVERLAP_ALLOW:
+	default:
+		return fmt.Errorf("%w: unknown overlap policy %q", ErrInvalidTask, def.Overlap)
+	}
+	schedule, err := parseCron(def.Schedule, def.TimeZone)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTask, err)
+	}
+	if schedule.next(time.Now()).IsZero() {
+		return fmt.Errorf("%w: schedule %q never fires", ErrInvalidTask, def.Schedule)
+	}
+	def.schedule = schedule
+	return validateTaskSpec(def.Task)
+}
+
+// queueRecurringRun adds the next run of a definition after the given time to the scheduler queue.
+// Must be called with the store lock held.
+func queueRecurringRun(def *RecurringTask, after time.Time) {
+	runTime := def.schedule.next(after)
+	if runTime.IsZero() {
+		return
+	}
+	spec := def.Task
+	spec.RunTime = runTime
+	if spec.Description == "" {
+		spec.Description = def.Name
+	}
+	task := &Task{
+		TaskSpec:      spec,
+		ID:            nextTaskID(),
+		CreatedTime:   time.Now(),
+		Status:        TASK_STATUS_PENDING,
+		RecurringTask: def.Name,
+		queueIndex:    -1,
+		readyIndex:    -1,
+	}
+	tasks.tasks[task.ID] = task
+	heap.Push(&tasks.queue, task)
+}
+
+// continueRecurring queues the run that follows a run leaving the queue, whether it starts, is skipped or is
+// cancelled. Must be called with the store lock held.
+func continueRecurring(run *Task, after time.Time) {
+	if def, ok := tasks.recurring[run.RecurringTask]; ok {
+		queueRecurringRun(def, after)
+	}
+}
+
+// admitRecurringRun applies the overlap policy to a run that is due and tells if it can start now.
+// Must be called with the store lock held.
+func admitRecurringRun(run *Task) bool {
+	def, ok := tasks.recurring[run.RecurringTask]
+	if !ok {
+		return true
+	}
+	if def.running == 0 || def.Overlap == OVERLAP_ALLOW {
+		def.running++
+		return true
+	}
+
+	if def.Overlap == OVERLAP_QUEUE {
+		def.waiting = append(def.waiting, run)
+		return false
+	}
+	cancelTask(run, fmt.Sprintf("skipped, the previous run of %s is still running", def.Name))
+	log.Printf("Task %d (%s) skipped, the previous run is still running", run.ID, run.Description)
+	return false
+}
+
+// finishRecurringRun releases the slot of a finished run and starts the next waiting one.
+// Must be called with the store lock held.
+func finishRecurringRun(run *Task) {
+	def, ok := tasks.recurring[run.RecurringTask]
+	if !ok || def.running == 0 {
+		return
+	}
+	def.running--
+	startWaitingRun(def)
+}
+
+// startWaitingRun starts the first run held back by the queue overlap policy once no run is left,
+// must be called with the store lock held.
+func startWaitingRun(def *RecurringTask) {
+	if def.running == 0 && len(def.waiting) > 0 {
+		next := def.waiting[0]
+		def.waiting = def.waiting[1:]
+		def.running++
+		enqueueTask(next)
+	}
+}
+
+// dropWaitingRun takes a run out of the queue overlap list when it is removed, must be called with the store lock held.
+func dropWaitingRun(run *Task) {
+	def, ok := tasks.recurring[run.RecurringTask]
+	if !ok {
+		return
+	}
+	for i, waiting := range def.waiting {
+		if waiting == run {
+			def.waiting = append(def.waiting[:i], def.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// CreateRecurringTask registers a recurring task and queues its first run.
+func CreateRecurringTask(def RecurringTask) (RecurringTask, error) {
+	var err error
+	if def.Task, err = expandTaskTemplate(def.Task); err != nil {
+		return RecurringTask{}, err
+	}
+	if err := validateRecurringTask(&def); err != nil {
+		return RecurringTask{}, err
+	}
+
+	tasks.Lock()
+	defer tasks.Unlock()
+	if _, ok := tasks.recurring[def.Name]; ok {
+		return RecurringTask{}, fmt.Errorf("%w: %s", ErrRecurringTaskExists, def.Name)
+	}
+	def.CreatedTime = time.Now()
+	def.Task.RunTime = time.Time{}
+	stored := &def
+	tasks.recurring[def.Name] = stored
+
+	queueRecurringRun(stored, time.Now())
+	persistRecurringTasks()
+	persistTasks()
+	wakeScheduler()
+	return stored.snapshot(), nil
+}
+
+// ListRecurringTasks returns copies of every recurring task, sorted by name.
+func ListRecurringTasks() []RecurringTask {
+	tasks.RLock()
+	defer tasks.RUnlock()
+
+	list := make([]RecurringTask, 0, len(tasks.recurring))
+	for _, def := range tasks.recurring {
+		list = append(list, def.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GetRecurringTask returns a copy of one recurring task.
+func GetRecurringTask(name string) (RecurringTask, error) {
+	tasks.RLock()
+	defer tasks.RUnlock()
+
+	def, ok := tasks.recurring[name]
+	if !ok {
+		return RecurringTask{}, fmt.Errorf("%w: no recurring task %s", ErrTaskNotFound, name)
+	}
+	return def.snapshot(), nil
+}
+
+// DeleteRecurringTask removes a recurring task and cancels its runs that have not started, running ones finish.
+func DeleteRecurringTask(name string) error {
+	tasks.Lock()
+	defer tasks.Unlock()
+
+	def, ok := tasks.recurring[name]
+	if !ok {
+		return fmt.Errorf("%w: no recurring task %s", ErrTaskNotFound, name)
+	}
+	delete(tasks.recurring, name)
+
+	pending := append([]*Task(nil), def.waiting...)
+	for _, task := range tasks.queue {
+		if task.RecurringTask == name {
+			pending = append(pending, task)
+		}
+	}
+	for _, task := range pending {
+		if task.queueIndex >= 0 {
+			heap.Remove(&tasks.queue, task.queueIndex)
+		}
+		cancelTask(task, fmt.Sprintf("recurring task %s was deleted", name))
+	}
+
+	persistRecurringTasks()
+	persistTasks()
+	wakeScheduler()
+	return nil
+}
+
+// NextRecurringRuns previews the next n run times of a recurring task.
+func NextRecurringRuns(name string, n int) ([]time.Time, error) {
+	tasks.RLock()
+	def, ok := tasks.recurring[name]
+	tasks.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: no recurring task %s", ErrTaskNotFound, name)
+	}
+	return def.schedule.upcoming(time.Now(), n), nil
+}
+
+// PreviewCronSchedule returns the next n times of a cron expression, to try one before creating a recurring task.
+func PreviewCronSchedule(expr, zone string, n int) ([]time.Time, error) {
+	schedule, err := parseCron(expr, zone)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTask, err)
+	}
+	return schedule.upcoming(time.Now(), n), nil
+}
+
+// persistRecurringTasks writes the definitions to their state file, must be called with the store lock held.
+func persistRecurringTasks() {
+	defs := make([]*RecurringTask, 0, len(tasks.recurring))
+	for _, def := range tasks.recurring {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+
+	data, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding recurring tasks: %v", err)
+		return
+	}
+	if err := writeFileAtomic(RecurringTaskFile, data); err != nil {
+		log.Printf("Error writing recurring tasks %s: %v", RecurringTaskFile, err)
+	}
+}
+
+// readRecurringTasks reads the definitions file, nil when there is none or it cannot be read.
+func readRecurringTasks() []*RecurringTask {
+	data, err := os.ReadFile(RecurringTaskFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error reading recurring tasks %s: %v", RecurringTaskFile, err)
+		return nil
+	}
+	var defs []*RecurringTask
+	if err := json.Unmarshal(data, &defs); err != nil {
+		log.Printf("Error decoding recurring tasks %s: %v", RecurringTaskFile, err)
+		return nil
+	}
+	return defs
+}
+
+// restoreRecurringTasks loads the definitions and queues a run for every one whose next run was not restored
+// with the scheduled tasks. The waiting runs go back to their definitions, the first of each starts right away.
+func restoreRecurringTasks(waiting []*Task) {
+	defs := readRecurringTasks()
+	if defs == nil && len(waiting) == 0 {
+		return
+	}
+
+	tasks.Lock()
+	defer tasks.Unlock()
+
+	queued := make(map[string]bool)
+	for _, task := range tasks.queue {
+		queued[task.RecurringTask] = true
+	}
+	for _, def := range defs {
+		schedule, err := parseCron(def.Schedule, def.TimeZone)
+		if err != nil {
+			log.Printf("Error restoring recurring task %s: %v", def.Name, err)
+			continue
+		}
+		def.schedule = schedule
+		tasks.recurring[def.Name] = def
+		if !queued[def.Name] {
+			queueRecurringRun(def, time.Now())
+		}
+	}
+	for _, task := range waiting {
+		def, ok := tasks.recurring[task.RecurringTask]
+		if !ok {
+			cancelTask(task, fmt.Sprintf("recurring task %s no longer exists", task.RecurringTask))
+			continue
+		}
+		def.waiting = append(def.waiting, task)
+	}
+	for _, def := range tasks.recurring {
+		startWaitingRun(def)
+	}
+	persistTasks()
+	log.Printf("Restored %d recurring tasks from %s", len(tasks.recurring), RecurringTaskFile)
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// RestartPolicy decides whether a supervised service is brought back after its process exits on its own.
+type RestartPolicy string
+
+const (
+	RESTART_POLICY_NO         RestartPolicy = "no"
+	RESTART_POLICY_ON_FAILURE RestartPolicy = "on-failure"
+	RESTART_POLICY_ALWAYS     RestartPolicy = "always"
+)
+
+// defaults used when a spec leaves the backoff settings empty
+const (
+	defaultRestartDelay    = time.Second
+	defaultRestartMaxDelay = time.Minute
+	defaultRestartLimit    = 5
+	defaultRestartWindow   = 5 * time.Minute
+)
+
+// validateRestart rejects unknown policies and negative backoff settings.
+func validateRestart(spec ServiceSpec) error {
+	switch spec.Restart {
+	case "", RESTART_POLICY_NO, RESTART_POLICY_ON_FAILURE, RESTART_POLICY_ALWAYS:
+	default:
+		return fmt.Errorf("restart policy %q for service %s must be one of no, on-failure or always", spec.Restart, spec.Name)
+	}
+	if spec.RestartDelay < 0 || spec.RestartMaxDelay < 0 || spec.RestartLimit < 0 || spec.RestartWindow < 0 {
+		return fmt.Errorf("restart settings for service %s cannot be negative", spec.Name)
+	}
+	return nil
+}
+
+// shouldRestart tells if the policy of the spec asks for a restart after the given exit code.
+func shouldRestart(spec ServiceSpec, code int) bool {
+	switch spec.Restart {
+	case RESTART_POLICY_ALWAYS:
+		return true
+	case RESTART_POLICY_ON_FAILURE:
+		return code != 0
+	}
+	return false
+}
+
+// restartSettings fills the spec backoff settings with their defaults.
+func restartSettings(spec ServiceSpec) (delay, maxDelay time.Duration, limit int, window time.Duration) {
+	delay, maxDelay, limit, window = defaultRestartDelay, defaultRestartMaxDelay, defaultRestartLimit, defaultRestartWindow
+	if spec.RestartDelay > 0 {
+		delay = time.Duration(spec.RestartDelay) * time.Second
+	}
+	if spec.RestartMaxDelay > 0 {
+		maxDelay = time.Duration(spec.RestartMaxDelay) * time.Second
+	}
+	if spec.RestartLimit > 0 {
+		limit = spec.RestartLimit
+	}
+	if spec.RestartWindow > 0 {
+		window = time.Duration(spec.RestartWindow) * time.Second
+	}
+	return
+}
+
+// backoffDelay doubles the base delay for every restart already done in the window, capped at maxDelay.
+func backoffDelay(base, maxDelay time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// scheduleRestart applies the restart policy after an unexpected exit, must be called with the store lock held.
+func scheduleRestart(service *ServiceInfo, code int) {
+	exit := errors.New(service.LastExitReason)
+	if !shouldRestart(service.Spec, code) {
+		if code != 0 {
+			setStatus(service, SERVICE_STATUS_FAILED, ACTOR_SUPERVISOR, exit)
+		} else {
+			setStatus(service, SERVICE_STATUS_STOPPED, ACTOR_SUPERVISOR, nil)
+		}
+		return
+	}
+
+	delay, maxDelay, limit, window := restartSettings(service.Spec)
+
+	// forget the restarts that fell out of the window
+	now := time.Now()
+	recent := service.restartTimes[:0]
+	for _, t := range service.restartTimes {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	service.restartTimes = recent
+
+	if len(recent) >= limit {
+		service.LastExitReason = fmt.Sprintf("%s, gave up after %d restarts within %s", service.LastExitReason, len(recent), window)
+		setStatus(service, SERVICE_STATUS_FAILED, ACTOR_RESTART_POLICY, errors.New(service.LastExitReason))
+		log.Printf("Service %s is crash looping, not restarting it anymore", service.Name)
+		return
+	}
+
+	wait := backoffDelay(delay, maxDelay, len(recent))
+	setStatus(service, SERVICE_STATUS_BACKOFF, ACTOR_SUPERVISOR, exit)
+	service.NextRestart = now.Add(wait)
+	log.Printf("Service %s restarting in %s", service.Name, wait)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		serviceList.Lock()
+		defer serviceList.Unlock()
+
+		// the restart was cancelled by a stop, an uninstall or a manual start meanwhile
+		if service.restartTimer != timer || service.Status != SERVICE_STATUS_BACKOFF {
+			return
+		}
+		service.restartTimer = nil
+		service.NextRestart = time.Time{}
+		service.restartTimes = append(service.restartTimes, time.Now())
+		service.Restarts++
+
+		if err := spawnService(service); err != nil {
+			service.LastExitReason = err.Error()
+			setStatus(service, SERVICE_STATUS_FAILED, ACTOR_RESTART_POLICY, err)
+			log.Printf("Restarting service %s failed: %v", service.Name, err)
+			return
+		}
+		setStatus(service, SERVICE_STATUS_STARTED, ACTOR_RESTART_POLICY, nil)
+	})
+	service.restartTimer = timer
+}
+
+// resetRestarts cancels a pending restart and clears the restart history, must be called with the store lock held.
+func resetRestarts(service *ServiceInfo) {
+	if service.restartTimer != nil {
+		service.restartTimer.Stop()
+		service.restartTimer = nil
+	}
+	service.restartTimes = nil
+	service.NextRestart = time.Time{}
+	service.Restarts = 0
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTempLogDir sends the service logs written by a test to a temporary directory.
+func useTempLogDir(t *testing.T) {
+	t.Helper()
+	saved := ServiceLogDir
+	ServiceLogDir = t.TempDir()
+	t.Cleanup(func() { ServiceLogDir = saved })
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		base, max time.Duration
+		attempt   int
+		want      time.Duration
+	}{
+		{time.Second, time.Minute, 0, time.Second},
+		{time.Second, time.Minute, 1, 2 * time.Second},
+		{time.Second, time.Minute, 5, 32 * time.Second},
+		{time.Second, time.Minute, 6, time.Minute},
+		{time.Second, time.Minute, 1000, time.Minute},
+		{3 * time.Second, 10 * time.Second, 2, 10 * time.Second},
+		{time.Minute, time.Second, 0, time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoffDelay(tt.base, tt.max, tt.attempt); got != tt.want {
+			t.Errorf("backoffDelay(%s, %s, %d) = %s, want %s", tt.base, tt.max, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+// restartAfter runs scheduleRestart on a service that restarted at the given times and returns it once the
+// pending restart, if any, is cancelled again.
+func restartAfter(t *testing.T, spec ServiceSpec, code int, restarts []time.Time) *ServiceInfo {
+	t.Helper()
+	service := &ServiceInfo{Name: spec.Name, Spec: spec, Status: SERVICE_STATUS_STARTED, LastExitReason: fmt.Sprintf("exited with code %d", code)}
+	service.restartTimes = append([]time.Time(nil), restarts...)
+
+	// the service is in no store, the timer taking the store lock is stopped before it can fire
+	scheduleRestart(service, code)
+	if service.restartTimer != nil {
+		service.restartTimer.Stop()
+	}
+	return service
+}
+
+func TestScheduleRestartBackoff(t *testing.T) {
+	useTempLogDir(t)
+	spec := ServiceSpec{Name: "backoff", Restart: RESTART_POLICY_ALWAYS, RestartDelay: 1, RestartMaxDelay: 10, RestartLimit: 10, RestartWindow: 60}
+
+	ago := func(seconds ...int) []time.Time {
+		times := make([]time.Time, len(seconds))
+		for i, s := range seconds {
+			times[i] = time.Now().Add(-time.Duration(s) * time.Second)
+		}
+		return times
+	}
+	tests := []struct {
+		name     string
+		restarts []time.Time
+		wait     time.Duration
+		kept     int
+	}{
+		{"first exit", nil, time.Second, 0},
+		{"one restart", ago(5), 2 * time.Second, 1},
+		{"three restarts", ago(30, 20, 10), 8 * time.Second, 3},
+		{"capped", ago(50, 40, 30, 20, 10), 10 * time.Second, 5},
+		// restarts older than the window no longer count
+		{"out of the window", ago(300, 200, 120, 10), 2 * time.Second, 1},
+		{"all out of the window", ago(300, 200, 100), time.Second, 0},
+	}
+	for _, tt := range tests {
+		before := time.Now()
+		service := restartAfter(t, spec, 1, tt.restarts)
+		if service.Status != SERVICE_STATUS_BACKOFF {
+			t.Errorf("%s: status %s, want %s", tt.name, service.Status, SERVICE_STATUS_BACKOFF)
+			continue
+		}
+		if wait := service.NextRestart.Sub(before); wait < tt.wait || wait > tt.wait+time.Second {
+			t.Errorf("%s: restart in %s, want %s", tt.name, wait, tt.wait)
+		}
+		if len(service.restartTimes) != tt.kept {
+			t.Errorf("%s: %d restarts kept in the window, want %d", tt.name, len(service.restartTimes), tt.kept)
+		}
+	}
+}
+
+func TestScheduleRestartLimit(t *testing.T) {
+	useTempLogDir(t)
+	spec := ServiceSpec{Name: "limit", Restart: RESTART_POLICY_ON_FAILURE, RestartLimit: 3, RestartWindow: 60}
+	now := time.Now()
+
+	within := []time.Time{now.Add(-50 * time.Second), now.Add(-30 * time.Second), now.Add(-time.Second)}
+	service := restartAfter(t, spec, 1, within)
+	if service.Status != SERVICE_STATUS_FAILED || service.restartTimer != nil {
+		t.Fatalf("status %s after 3 restarts in the window, want %s without a pending restart", service.Status, SERVICE_STATUS_FAILED)
+	}
+	if want := "gave up after 3 restarts within 1m0s"; !strings.Contains(service.LastExitReason, want) {
+		t.Errorf("exit reason %q, want it to contain %q", service.LastExitReason, want)
+	}
+
+	// the same number of restarts spread past the window is not a crash loop
+	spread := []time.Time{now.Add(-200 * time.Second), now.Add(-30 * time.Second), now.Add(-time.Second)}
+	if service := restartAfter(t, spec, 1, spread); service.Status != SERVICE_STATUS_BACKOFF {
+		t.Errorf("status %s with one restart out of the window, want %s", service.Status, SERVICE_STATUS_BACKOFF)
+	}
+}
+
+func TestScheduleRestartPolicy(t *testing.T) {
+	useTempLogDir(t)
+	tests := []struct {
+		policy RestartPolicy
+		code   int
+		want   ServiceStatus
+	}{
+		{"", 1, SERVICE_STATUS_FAILED},
+		{RESTART_POLICY_NO, 0, SERVICE_STATUS_STOPPED},
+		{RESTART_POLICY_NO, 1, SERVICE_STATUS_FAILED},
+		{RESTART_POLICY_ON_FAILURE, 0, SERVICE_STATUS_STOPPED},
+		{RESTART_POLICY_ON_FAILURE, 2, SERVICE_STATUS_BACKOFF},
+		{RESTART_POLICY_ALWAYS, 0, SERVICE_STATUS_BACKOFF},
+	}
+	for _, tt := range tests {
+		service := restartAfter(t, ServiceSpec{Name: "policy", Restart: tt.policy}, tt.code, nil)
+		if service.Status != tt.want {
+			t.Errorf("policy %q, exit code %d: status %s, want %s", tt.policy, tt.code, service.Status, tt.want)
+		}
+	}
+}
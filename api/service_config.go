@@ -0,0 +1,374 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ServiceConfigDir holds the declarative service definitions, one YAML (or JSON) file per service.
+var ServiceConfigDir = "services.d"
+
+// serviceFile is the content of a definition file: a service spec plus whether it should run at boot.
+type serviceFile struct {
+	ServiceSpec
+	Enabled bool `json:"enabled"`
+}
+
+// ServicePlan is the difference between the definition files and the live services.
+type ServicePlan struct {
+	Add    []ServicePlanEntry `json:"add"`
+	Change []ServicePlanEntry `json:"change"`
+	Remove []ServicePlanEntry `json:"remove"`
+	Errors []string           `json:"errors"` // files that cannot be loaded, a plan with errors is never applied
+}
+
+// ServicePlanEntry is one service the plan touches, Fields lists what changes for an update.
+type ServicePlanEntry struct {
+	Name       string       `json:"name"`
+	ConfigFile string       `json:"config_file"`
+	Fields     []string     `json:"fields,omitempty"`
+	Spec       *ServiceSpec `json:"spec,omitempty"`
+	Enabled    bool         `json:"enabled"`
+}
+
+// only one plan is applied at a time, SIGHUP and the watcher may fire together
+var applyMutex sync.Mutex
+
+// loadServiceFile decodes one definition file, YAML is converted to JSON so the spec keeps a single set of field names.
+func loadServiceFile(path string) (serviceFile, error) {
+	var file serviceFile
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file, err
+	}
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return file, err
+	}
+	if raw == nil {
+		return file, errors.New("file is empty")
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return file, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return file, err
+	}
+
+	// the file name is the service name unless the file says otherwise
+	if file.Name == "" {
+		file.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return file, validateServiceName(file.Name)
+}
+
+// loadServiceConfig reads every definition file of the config directory.
+func loadServiceConfig() (map[string]serviceFile, map[string]string, []string) {
+	files := make(map[string]serviceFile)
+	sources := make(map[string]string)
+	problems := make([]string, 0)
+
+	entries, err := os.ReadDir(ServiceConfigDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, err.Error())
+		}
+		return files, sources, problems
+	}
+
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+		case ".toml":
+			// reported rather than skipped, a definition left out silently would be applied as an uninstall
+			problems = append(problems, fmt.Sprintf("%s: TOML definitions are not supported, write it as YAML or JSON",
+				filepath.Join(ServiceConfigDir, entry.Name())))
+			continue
+		default:
+			continue
+		}
+		path := filepath.Join(ServiceConfigDir, entry.Name())
+		file, err := loadServiceFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		if other, ok := sources[file.Name]; ok {
+			problems = append(problems, fmt.Sprintf("%s: service %s is already defined in %s", path, file.Name, other))
+			continue
+		}
+		if file.Command != "" {
+			if err := validateSpec(file.ServiceSpec); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+				continue
+			}
+		}
+		if err := validateHealthCheck(file.Name, file.HealthCheck); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		files[file.Name] = file
+		sources[file.Name] = path
+	}
+	return files, sources, problems
+}
+
+// changedFields names the spec fields that differ, using their JSON names.
+func changedFields(old, new ServiceSpec) []string {
+	var a, b map[string]json.RawMessage
+	oldJSON, _ := json.Marshal(old)
+	newJSON, _ := json.Marshal(new)
+	json.Unmarshal(oldJSON, &a)
+	json.Unmarshal(newJSON, &b)
+
+	fields := make([]string, 0)
+	for key, value := range a {
+		if other, ok := b[key]; !ok || !bytes.Equal(value, other) {
+			fields = append(fields, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			fields = append(fields, key)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// PlanServiceConfig compares the config directory with the live services without changing anything.
+func PlanServiceConfig() ServicePlan {
+	files, sources, problems := loadServiceConfig()
+	plan := ServicePlan{
+		Add:    make([]ServicePlanEntry, 0),
+		Change: make([]ServicePlanEntry, 0),
+		Remove: make([]ServicePlanEntry, 0),
+		Errors: problems,
+	}
+
+	serviceList.RLock()
+	defer serviceList.RUnlock()
+
+	// the resulting graph must stay acyclic, hand installed services included
+	specs := make(map[string]ServiceSpec)
+	for name, service := range serviceList.services {
+		if service.ConfigFile == "" {
+			specs[name] = service.Spec
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		file := files[name]
+		spec := file.ServiceSpec
+		specs[name] = spec
+		entry := ServicePlanEntry{Name: name, ConfigFile: sources[name], Spec: &spec, Enabled: file.Enabled}
+
+		service, ok := serviceList.services[name]
+		if !ok {
+			plan.Add = append(plan.Add, entry)
+			continue
+		}
+		if service.ConfigFile == "" {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("%s: service %s is already installed by hand", sources[name], name))
+			continue
+		}
+		entry.Fields = changedFields(service.Spec, spec)
+		if service.Enabled != file.Enabled {
+			entry.Fields = append(entry.Fields, "enabled")
+		}
+		if service.ConfigFile != sources[name] {
+			entry.Fields = append(entry.Fields, "config_file")
+		}
+		if len(entry.Fields) > 0 {
+			plan.Change = append(plan.Change, entry)
+		}
+	}
+
+	for name, service := range serviceList.services {
+		if _, ok := files[name]; !ok && service.ConfigFile != "" {
+			plan.Remove = append(plan.Remove, ServicePlanEntry{Name: name, ConfigFile: service.ConfigFile})
+		}
+	}
+	sort.Slice(plan.Remove, func(i, j int) bool { return plan.Remove[i].Name < plan.Remove[j].Name })
+
+	if cycle := findCycle(specs); cycle != nil {
+		plan.Errors = append(plan.Errors, fmt.Sprintf("definitions create a dependency cycle: %s", strings.Join(cycle, " -> ")))
+	}
+	return plan
+}
+
+// ApplyServiceConfig brings the live services in line with the config directory and returns what it did.
+func ApplyServiceConfig() (ServicePlan, error) {
+	applyMutex.Lock()
+	defer applyMutex.Unlock()
+
+	plan := PlanServiceConfig()
+	if len(plan.Errors) > 0 {
+		return plan, fmt.Errorf("service definitions not applied: %s", strings.Join(plan.Errors, "; "))
+	}
+
+	var failures []string
+	// a service is only uninstalled once nothing requires it, services removed together go dependents first
+	pending := plan.Remove
+	for len(pending) > 0 {
+		refused := make([]ServicePlanEntry, 0)
+		errs := make(map[string]error)
+		for _, entry := range pending {
+			err := Uninstall(entry.Name, ACTOR_CONFIG)
+			if errors.Is(err, ErrServiceRequired) {
+				refused = append(refused, entry)
+				errs[entry.Name] = err
+			} else if err != nil {
+				failures = append(failures, fmt.Sprintf("remove %s: %v", entry.Name, err))
+			}
+		}
+		if len(refused) == len(pending) {
+			for _, entry := range refused {
+				failures = append(failures, fmt.Sprintf("remove %s: %v", entry.Name, errs[entry.Name]))
+			}
+			break
+		}
+		pending = refused
+	}
+	for _, entry := range plan.Add {
+		if err := installSpec(*entry.Spec, entry.ConfigFile, ACTOR_CONFIG); err != nil {
+			failures = append(failures, fmt.Sprintf("add %s: %v", entry.Name, err))
+			continue
+		}
+		if entry.Enabled {
+			Enable(entry.Name)
+		}
+	}
+	for _, entry := range plan.Change {
+		if err := updateService(*entry.Spec, entry.ConfigFile, entry.Enabled); err != nil {
+			failures = append(failures, fmt.Sprintf("change %s: %v", entry.Name, err))
+		}
+	}
+
+	// enabled services that were just added come up once their install settled
+	for _, entry := range plan.Add {
+		if entry.Enabled {
+			go func(name string) {
+				if _, err := waitSettled(name); err == nil {
+					Start(name, ACTOR_CONFIG)
+				}
+			}(entry.Name)
+		}
+	}
+
+	log.Printf("Service definitions applied: %d added, %d changed, %d removed", len(plan.Add), len(plan.Change), len(plan.Remove))
+	if len(failures) > 0 {
+		return plan, errors.New(strings.Join(failures, "; "))
+	}
+	return plan, nil
+}
+
+// updateService replaces the spec of a config managed service, restarting it when it was running.
+func updateService(spec ServiceSpec, configFile string, enabled bool) error {
+	serviceList.Lock()
+	service, ok := serviceList.services[spec.Name]
+	if !ok {
+		serviceList.Unlock()
+		return fmt.Errorf("service %s not found in the system", spec.Name)
+	}
+	if err := validateDependencies(spec); err != nil {
+		serviceList.Unlock()
+		return err
+	}
+	running := service.DesiredRunning
+	specChanged := !reflect.DeepEqual(service.Spec, spec)
+	dependents := runningDependents(spec.Name)
+	serviceList.Unlock()
+
+	if specChanged && running {
+		if err := Stop(spec.Name, ACTOR_CONFIG); err != nil && !errors.Is(err, ErrInvalidTransition) {
+			return err
+		}
+		if _, err := waitSettled(spec.Name); err != nil {
+			return err
+		}
+	}
+
+	serviceList.Lock()
+	service.Spec = spec
+	service.ConfigFile = configFile
+	service.Enabled = enabled
+	if specChanged {
+		stopHealthMonitor(service)
+		startHealthMonitor(service)
+	}
+	persistServices()
+	serviceList.Unlock()
+
+	if specChanged && running {
+		if err := Start(spec.Name, ACTOR_CONFIG); err != nil {
+			return err
+		}
+		go startDependents(spec.Name, dependents, ACTOR_CONFIG)
+	}
+	return nil
+}
+
+// configFingerprint summarises names, sizes and modification times of the definition files.
+func configFingerprint() string {
+	entries, err := os.ReadDir(ServiceConfigDir)
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String()
+}
+
+// WatchServiceConfig applies the config directory once, then again every time its files change.
+func WatchServiceConfig(interval time.Duration) {
+	last := configFingerprint()
+	if last != "" {
+		if _, err := ApplyServiceConfig(); err != nil {
+			log.Printf("Error applying service definitions: %v", err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		current := configFingerprint()
+		if current == last {
+			continue
+		}
+		last = current
+		log.Printf("Service definitions in %s changed, applying them", ServiceConfigDir)
+		if _, err := ApplyServiceConfig(); err != nil {
+			log.Printf("Error applying service definitions: %v", err)
+		}
+	}
+}
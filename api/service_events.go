@@ -0,0 +1,93 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// actors for the transitions the panel does on its own, requests carry the name of whoever asked
+const (
+	ACTOR_SUPERVISOR     = "supervisor"
+	ACTOR_RESTART_POLICY = "restart-policy"
+	ACTOR_HEALTH_CHECK   = "health-check"
+	ACTOR_BOOT           = "boot"
+	ACTOR_CONFIG         = "config"
+)
+
+// number of events kept for every service, older ones are dropped
+const serviceEventLimit = 200
+
+// ServiceEvent is one state transition of a service.
+type ServiceEvent struct {
+	Time     time.Time     `json:"time"`
+	Service  string        `json:"service"`
+	Actor    string        `json:"actor"`
+	Action   ServiceAction `json:"action,omitempty"` // empty for transitions nobody asked for, like a crash
+	From     ServiceStatus `json:"from"`
+	To       ServiceStatus `json:"to"`
+	Duration float64       `json:"duration_seconds"` // length of the operation, or time spent in From for unrequested transitions
+	Error    string        `json:"error,omitempty"`
+}
+
+// serviceEvents keeps the bounded history of every service, it outlives the service so uninstalls stay visible.
+// Lock order is serviceList then serviceEvents.
+var serviceEvents = struct {
+	sync.Mutex
+	events map[string][]ServiceEvent
+}{events: make(map[string][]ServiceEvent)}
+
+// recordEvent appends an event to the history of its service.
+func recordEvent(event ServiceEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	serviceEvents.Lock()
+	history := append(serviceEvents.events[event.Service], event)
+	if len(history) > serviceEventLimit {
+		history = history[len(history)-serviceEventLimit:]
+	}
+	serviceEvents.events[event.Service] = history
+	serviceEvents.Unlock()
+
+	message := fmt.Sprintf("%s -> %s by %s", event.From, event.To, event.Actor)
+	if event.Error != "" {
+		message += ": " + event.Error
+	}
+	serviceLogFor(event.Service).append(LOG_STREAM_PANEL, message)
+}
+
+// setStatus moves a service to a new state outside of any operation and records it, must be called with the store lock held.
+func setStatus(service *ServiceInfo, status ServiceStatus, actor string, err error) {
+	from := service.Status
+	service.Status = status
+
+	event := ServiceEvent{Service: service.Name, Actor: actor, From: from, To: status}
+	if !service.statusSince.IsZero() {
+		event.Duration = time.Since(service.statusSince).Seconds()
+	}
+	service.statusSince = time.Now()
+	if err != nil {
+		event.Error = err.Error()
+	}
+	recordEvent(event)
+}
+
+// GetServiceEvents returns the history of a service, oldest first, limited to the last limit events when limit is set.
+func GetServiceEvents(name string, limit int) ([]ServiceEvent, error) {
+	serviceEvents.Lock()
+	history, ok := serviceEvents.events[name]
+	events := append(make([]ServiceEvent, 0, len(history)), history...)
+	serviceEvents.Unlock()
+
+	if !ok {
+		if _, err := GetServiceStatus(name); err != nil {
+			return nil, err
+		}
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, nil
+}
@@ -0,0 +1,286 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceLogDir is where the output of every service is written, one <name>.log file per service plus its rotations.
+var ServiceLogDir = filepath.Join("data", "logs")
+
+// defaults used when a spec leaves the log settings empty
+const (
+	defaultLogMaxSize  = 10 << 20
+	defaultLogMaxFiles = 3
+)
+
+// longest line TailServiceLogs reads back, a service writing a line past it gets an error instead of a cut log
+const maxLogLineSize = 16 << 20
+
+// ErrLogUnreadable is returned when a service log file cannot be read to the end, the HTTP layer maps it to 500
+var ErrLogUnreadable = errors.New("service log cannot be read")
+
+// streams a log line can come from, panel is used for the messages written by the panel itself
+const (
+	LOG_STREAM_STDOUT = "stdout"
+	LOG_STREAM_STDERR = "stderr"
+	LOG_STREAM_PANEL  = "panel"
+)
+
+// LogLine is a single timestamped line of service output.
+type LogLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+// serviceLog is the size rotated log file of one service, plus the followers waiting for new lines.
+type serviceLog struct {
+	sync.Mutex
+
+	path        string
+	file        *os.File
+	size        int64
+	maxSize     int64
+	maxFiles    int
+	subscribers map[chan LogLine]struct{}
+}
+
+// serviceLogs holds the open log of every service that produced output since the panel started
+var serviceLogs = struct {
+	sync.Mutex
+	logs map[string]*serviceLog
+}{logs: make(map[string]*serviceLog)}
+
+// serviceLogFor returns the log of a service, creating it with the default limits the first time.
+func serviceLogFor(name string) *serviceLog {
+	serviceLogs.Lock()
+	defer serviceLogs.Unlock()
+
+	l, ok := serviceLogs.logs[name]
+	if !ok {
+		l = &serviceLog{
+			path:        filepath.Join(ServiceLogDir, name+".log"),
+			maxSize:     defaultLogMaxSize,
+			maxFiles:    defaultLogMaxFiles,
+			subscribers: make(map[chan LogLine]struct{}),
+		}
+		serviceLogs.logs[name] = l
+	}
+	return l
+}
+
+// configureServiceLog applies the log limits of a spec to its log.
+func configureServiceLog(spec ServiceSpec) *serviceLog {
+	l := serviceLogFor(spec.Name)
+	l.Lock()
+	defer l.Unlock()
+
+	l.maxSize = defaultLogMaxSize
+	if spec.LogMaxSize > 0 {
+		l.maxSize = spec.LogMaxSize
+	}
+	l.maxFiles = defaultLogMaxFiles
+	if spec.LogMaxFiles > 0 {
+		l.maxFiles = spec.LogMaxFiles
+	}
+	return l
+}
+
+// serviceLogf writes a panel message into the log of a service, used by the simulated services and the supervisor.
+func serviceLogf(name string, format string, args ...interface{}) {
+	serviceLogFor(name).append(LOG_STREAM_PANEL, fmt.Sprintf(format, args...))
+}
+
+// append writes one line to the file, rotating it first when it grew past its limit, and hands it to the followers.
+func (l *serviceLog) append(stream, text string) {
+	line := LogLine{Time: time.Now(), Stream: stream, Text: text}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if err := l.open(); err != nil {
+		log.Printf("Error opening service log %s: %v", l.path, err)
+	} else {
+		if l.size >= l.maxSize {
+			if err := l.rotate(); err != nil {
+				log.Printf("Error rotating service log %s: %v", l.path, err)
+			}
+		}
+		if l.file != nil {
+			n, _ := fmt.Fprintf(l.file, "%s %s %s\n", line.Time.Format(time.RFC3339Nano), line.Stream, line.Text)
+			l.size += int64(n)
+		}
+	}
+
+	for ch := range l.subscribers {
+		select {
+		case ch <- line:
+		default: // a slow follower misses lines rather than blocking the service
+		}
+	}
+}
+
+// open makes sure the current log file is open, must be called with the log lock held.
+func (l *serviceLog) open() error {
+	if l.file != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate shifts <name>.log.N up by one, dropping the oldest, and starts a new file, must be called with the log lock held.
+func (l *serviceLog) rotate() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.open()
+}
+
+// subscribe registers a follower, the returned function removes it again.
+func (l *serviceLog) subscribe() (chan LogLine, func()) {
+	ch := make(chan LogLine, 256)
+
+	l.Lock()
+	l.subscribers[ch] = struct{}{}
+	l.Unlock()
+
+	return ch, func() {
+		l.Lock()
+		delete(l.subscribers, ch)
+		l.Unlock()
+	}
+}
+
+// files returns the current file and its rotations, oldest first.
+func (l *serviceLog) files() []string {
+	l.Lock()
+	defer l.Unlock()
+
+	var paths []string
+	for i := l.maxFiles; i >= 1; i-- {
+		paths = append(paths, fmt.Sprintf("%s.%d", l.path, i))
+	}
+	return append(paths, l.path)
+}
+
+// parseLogLine reads back a line in the "<time> <stream> <text>" format written by append.
+func parseLogLine(raw string) (LogLine, bool) {
+	parts := strings.SplitN(raw, " ", 3)
+	if len(parts) < 2 {
+		return LogLine{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return LogLine{}, false
+	}
+	line := LogLine{Time: t, Stream: parts[1]}
+	if len(parts) == 3 {
+		line.Text = parts[2]
+	}
+	return line, true
+}
+
+// outputWriter splits the output of a process into lines for the service log, one per stream.
+type outputWriter struct {
+	log     *serviceLog
+	stream  string
+	pending []byte
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.log.append(w.stream, strings.TrimRight(string(w.pending[:i]), "\r"))
+		w.pending = w.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes out a last line that was not terminated by a newline.
+func (w *outputWriter) flush() {
+	if len(w.pending) > 0 {
+		w.log.append(w.stream, string(w.pending))
+		w.pending = nil
+	}
+}
+
+// TailServiceLogs returns up to tail of the latest lines of a service, only those written after since when it is set.
+func TailServiceLogs(name string, tail int, since time.Time) ([]LogLine, error) {
+	if _, err := GetServiceStatus(name); err != nil {
+		return nil, err
+	}
+
+	lines := make([]LogLine, 0)
+	for _, path := range serviceLogFor(name).files() {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), maxLogLineSize)
+		for scanner.Scan() {
+			line, ok := parseLogLine(scanner.Text())
+			if !ok || (!since.IsZero() && line.Time.Before(since)) {
+				continue
+			}
+			lines = append(lines, line)
+			if tail > 0 && len(lines) > 2*tail {
+				lines = append(lines[:0], lines[len(lines)-tail:]...)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrLogUnreadable, path, err)
+		}
+	}
+
+	if tail > 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	return lines, nil
+}
+
+// FollowServiceLogs returns a channel receiving every new line of a service until the returned stop function is called.
+func FollowServiceLogs(name string) (<-chan LogLine, func(), error) {
+	if _, err := GetServiceStatus(name); err != nil {
+		return nil, nil, err
+	}
+	ch, stop := serviceLogFor(name).subscribe()
+	return ch, stop, nil
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// ServiceStateFile keeps the installed service definitions and their desired state across panel restarts.
+var ServiceStateFile = filepath.Join("data", "services.json")
+
+// serviceRecord is what is persisted for every installed service.
+type serviceRecord struct {
+	Spec           ServiceSpec `json:"spec"`
+	Enabled        bool        `json:"enabled"`         // started whenever the panel boots
+	DesiredRunning bool        `json:"desired_running"` // running at the last start or stop
+	ConfigFile     string      `json:"config_file,omitempty"`
+}
+
+// writeFileAtomic replaces path with data so that readers only ever see the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// persistServices writes the registry to the state file, must be called with the store lock held.
+func persistServices() {
+	records := make(map[string]serviceRecord, len(serviceList.services))
+	for name, service := range serviceList.services {
+		if service.Status == SERVICE_STATUS_UNINSTALLING {
+			continue
+		}
+		records[name] = serviceRecord{
+			Spec:           service.Spec,
+			Enabled:        service.Enabled,
+			DesiredRunning: service.DesiredRunning,
+			ConfigFile:     service.ConfigFile,
+		}
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding service registry: %v", err)
+		return
+	}
+	if err := writeFileAtomic(ServiceStateFile, data); err != nil {
+		log.Printf("Error writing service registry %s: %v", ServiceStateFile, err)
+	}
+}
+
+// loadServices reads the state file, a missing file is an empty registry.
+func loadServices() (map[string]serviceRecord, error) {
+	records := make(map[string]serviceRecord)
+	data, err := os.ReadFile(ServiceStateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", ServiceStateFile, err)
+	}
+	return records, nil
+}
+
+// restoreServices registers the persisted services and starts the ones that should be running.
+func restoreServices() {
+	records, err := loadServices()
+	if err != nil {
+		log.Printf("Error loading service registry, starting empty: %v", err)
+		return
+	}
+
+	serviceList.Lock()
+	wanted := make(map[string]bool)
+	restored := 0
+	for name, record := range records {
+		if err := validateServiceName(name); err != nil {
+			log.Printf("Skipping restored service: %v", err)
+			continue
+		}
+		record.Spec.Name = name
+		service := &ServiceInfo{
+			Name:           name,
+			Spec:           record.Spec,
+			Status:         SERVICE_STATUS_STOPPED,
+			Enabled:        record.Enabled,
+			DesiredRunning: record.DesiredRunning,
+			ConfigFile:     record.ConfigFile,
+		}
+		serviceList.services[name] = service
+		restored++
+		startHealthMonitor(service)
+		if record.Enabled || record.DesiredRunning {
+			wanted[name] = true
+		}
+	}
+	order := orderServices(wanted)
+	serviceList.Unlock()
+
+	log.Printf("Restored %d services from %s", restored, ServiceStateFile)
+
+	// bring the actual state in line with the desired one, dependencies first
+	for _, name := range order {
+		if err := Start(name, ACTOR_BOOT); err != nil && !errors.Is(err, ErrInvalidTransition) && !errors.Is(err, ErrServiceBusy) {
+			log.Printf("Error starting restored service %s: %v", name, err)
+		}
+	}
+}
+
+// Enable marks a service to be started every time the panel boots.
+func Enable(serviceName string) error {
+	return setEnabled(serviceName, true)
+}
+
+// Disable stops starting a service at boot, it does not stop it.
+func Disable(serviceName string) error {
+	return setEnabled(serviceName, false)
+}
+
+func setEnabled(serviceName string, enabled bool) error {
+	serviceList.Lock()
+	defer serviceList.Unlock()
+
+	service, ok := serviceList.services[serviceName]
+	if !ok {
+		return fmt.Errorf("service %s not found in the system", serviceName)
+	}
+	service.Enabled = enabled
+	persistServices()
+	return nil
+}
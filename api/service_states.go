@@ -0,0 +1,102 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ServiceAction is one of the operations that can be requested on a service.
+type ServiceAction string
+
+const (
+	SERVICE_ACTION_INSTALL   ServiceAction = "install"
+	SERVICE_ACTION_START     ServiceAction = "start"
+	SERVICE_ACTION_STOP      ServiceAction = "stop"
+	SERVICE_ACTION_RELOAD    ServiceAction = "reload"
+	SERVICE_ACTION_UNINSTALL ServiceAction = "uninstall"
+	SERVICE_ACTION_RESTART   ServiceAction = "restart" // a stop followed by a start, it has no transition of its own
+)
+
+// errors returned when an action does not fit the current state, the HTTP layer maps both to 409 Conflict
+var (
+	ErrInvalidTransition = errors.New("invalid service state transition")
+	ErrServiceBusy       = errors.New("service has an operation in flight")
+)
+
+// serviceTransition lists the states an action may start from and the transient state the service is in while it runs.
+type serviceTransition struct {
+	from []ServiceStatus
+	via  ServiceStatus
+}
+
+// transition table for every action on an installed service, install itself only applies to unknown names
+var serviceTransitions = map[ServiceAction]serviceTransition{
+	SERVICE_ACTION_START: {
+		from: []ServiceStatus{SERVICE_STATUS_STOPPED, SERVICE_STATUS_FAILED, SERVICE_STATUS_BACKOFF},
+		via:  SERVICE_STATUS_STARTING,
+	},
+	SERVICE_ACTION_STOP: {
+		from: []ServiceStatus{SERVICE_STATUS_STARTED, SERVICE_STATUS_FAILED, SERVICE_STATUS_BACKOFF},
+		via:  SERVICE_STATUS_STOPPING,
+	},
+	SERVICE_ACTION_RELOAD: {
+		from: []ServiceStatus{SERVICE_STATUS_STARTED},
+		via:  SERVICE_STATUS_RELOADING,
+	},
+	SERVICE_ACTION_UNINSTALL: {
+		from: []ServiceStatus{SERVICE_STATUS_STOPPED, SERVICE_STATUS_STARTED, SERVICE_STATUS_FAILED, SERVICE_STATUS_BACKOFF},
+		via:  SERVICE_STATUS_UNINSTALLING,
+	},
+}
+
+// beginOperation validates action against the transition table and takes the per service operation lock,
+// the service moves to the transient state of the action. Must be called with the store lock held.
+func beginOperation(service *ServiceInfo, action ServiceAction, actor string) error {
+	if service.Operation != "" {
+		return fmt.Errorf("%w: cannot %s service %s while %s is in progress", ErrServiceBusy, action, service.Name, service.Operation)
+	}
+
+	transition, ok := serviceTransitions[action]
+	if !ok {
+		return fmt.Errorf("%w: unknown action %s", ErrInvalidTransition, action)
+	}
+	for _, status := range transition.from {
+		if status == service.Status {
+			service.Operation = action
+			service.opActor = actor
+			service.opFrom = service.Status
+			service.opStarted = time.Now()
+			service.Status = transition.via
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: cannot %s service %s while it is %s", ErrInvalidTransition, action, service.Name, service.Status)
+}
+
+// endOperation releases the operation lock, settles the service in its final state and records the transition.
+// Must be called with the store lock held.
+func endOperation(service *ServiceInfo, status ServiceStatus) {
+	failOperation(service, status, nil)
+}
+
+// failOperation is endOperation for an operation that went wrong, err ends up in the event history.
+func failOperation(service *ServiceInfo, status ServiceStatus, err error) {
+	event := ServiceEvent{
+		Service:  service.Name,
+		Actor:    service.opActor,
+		Action:   service.Operation,
+		From:     service.opFrom,
+		To:       status,
+		Duration: time.Since(service.opStarted).Seconds(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	service.Operation = ""
+	service.opActor = ""
+	service.Status = status
+	service.statusSince = time.Now()
+	recordEvent(event)
+}
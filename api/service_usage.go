@@ -0,0 +1,160 @@
+package api
+
+import (
+	"log"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// how often the process tree of every running service is sampled, and how many samples are kept
+const (
+	usageInterval     = 5 * time.Second
+	usageHistoryLimit = 120
+)
+
+// ResourceSample is the usage of a whole service process tree at one point in time.
+type ResourceSample struct {
+	Time       time.Time `json:"time"`
+	CPUPercent float64   `json:"cpu_percent"` // of a single core, so a busy tree can go over 100
+	RSS        uint64    `json:"rss"`
+	OpenFDs    int32     `json:"open_fds"`
+	Threads    int32     `json:"threads"`
+	Processes  int       `json:"processes"`
+}
+
+// ServiceResources is the latest sample of a service and its rolling history, oldest first.
+type ServiceResources struct {
+	Current ResourceSample   `json:"current"`
+	History []ResourceSample `json:"history"`
+}
+
+// usageTracker keeps what is needed to turn cumulative CPU times into a percentage between two samples.
+type usageTracker struct {
+	pid     int
+	cpuTime float64
+	sampled time.Time
+}
+
+// processTree returns the pid of every process below root, root included, from a parent map of the whole system.
+func processTree(root int32, children map[int32][]int32) []int32 {
+	tree := []int32{root}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree
+}
+
+// childrenMap reads the parent of every process once, so all services share a single scan of /proc.
+func childrenMap() (map[int32][]int32, error) {
+	pids, err := process.Pids()
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int32][]int32)
+	for _, pid := range pids {
+		proc, err := process.NewProcess(pid)
+		if err != nil {
+			continue
+		}
+		ppid, err := proc.Ppid()
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], pid)
+	}
+	return children, nil
+}
+
+// sampleTree adds up the usage of every process of a tree, processes that vanish meanwhile are skipped.
+// It returns the sample without its CPU percentage and the cumulative CPU seconds of the tree.
+func sampleTree(pids []int32) (ResourceSample, float64) {
+	sample := ResourceSample{Time: time.Now()}
+	var cpuTime float64
+
+	for _, pid := range pids {
+		proc, err := process.NewProcess(pid)
+		if err != nil {
+			continue
+		}
+		if times, err := proc.Times(); err == nil {
+			cpuTime += times.User + times.System
+		}
+		if mem, err := proc.MemoryInfo(); err == nil {
+			sample.RSS += mem.RSS
+		}
+		if fds, err := proc.NumFDs(); err == nil {
+			sample.OpenFDs += fds
+		}
+		if threads, err := proc.NumThreads(); err == nil {
+			sample.Threads += threads
+		}
+		sample.Processes++
+	}
+	return sample, cpuTime
+}
+
+// sampleServices records one usage sample for every running supervised service.
+func sampleServices() {
+	serviceList.RLock()
+	roots := make(map[string]int)
+	for name, service := range serviceList.services {
+		if service.proc != nil && service.PID != 0 {
+			roots[name] = service.PID
+		}
+	}
+	serviceList.RUnlock()
+
+	if len(roots) == 0 {
+		return
+	}
+	children, err := childrenMap()
+	if err != nil {
+		log.Printf("Error listing processes for service usage: %v", err)
+		return
+	}
+
+	for name, pid := range roots {
+		sample, cpuTime := sampleTree(processTree(int32(pid), children))
+
+		serviceList.Lock()
+		service, ok := serviceList.services[name]
+		if !ok || service.PID != pid {
+			serviceList.Unlock()
+			continue
+		}
+
+		// a new process starts a new CPU baseline
+		if service.usage == nil || service.usage.pid != pid {
+			service.usage = &usageTracker{pid: pid}
+		}
+		if !service.usage.sampled.IsZero() {
+			elapsed := sample.Time.Sub(service.usage.sampled).Seconds()
+			if elapsed > 0 && cpuTime >= service.usage.cpuTime {
+				sample.CPUPercent = (cpuTime - service.usage.cpuTime) / elapsed * 100
+			}
+		}
+		service.usage.cpuTime = cpuTime
+		service.usage.sampled = sample.Time
+
+		if service.Resources == nil {
+			service.Resources = &ServiceResources{}
+		}
+		service.Resources.Current = sample
+		service.Resources.History = append(service.Resources.History, sample)
+		if len(service.Resources.History) > usageHistoryLimit {
+			service.Resources.History = service.Resources.History[len(service.Resources.History)-usageHistoryLimit:]
+		}
+		serviceList.Unlock()
+	}
+}
+
+// monitorServiceUsage samples the running services and checks their limits for as long as the panel runs.
+func monitorServiceUsage() {
+	ticker := time.NewTicker(usageInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sampleServices()
+		checkLimitHits()
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"regexp"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -22,14 +25,110 @@ const (
 	SERVICE_STATUS_STOPPED      ServiceStatus = "STOPPED"    // (all uppercase and separated to space) for exported variables with string type at local implementations also!. ( for all static const etc.. if export to be a valid public access code variables )
 	SERVICE_STATUS_INSTALLING   ServiceStatus = "INSTALLING" //
 	SERVICE_STATUS_UNINSTALLING ServiceStatus = "UNINSTALLING"
+	SERVICE_STATUS_BACKOFF      ServiceStatus = "BACKOFF" // supervised process exited and waits for its next restart
+	SERVICE_STATUS_FAILED       ServiceStatus = "FAILED"  // restart policy gave up, needs a manual start
+	SERVICE_STATUS_STARTING     ServiceStatus = "STARTING"
+	SERVICE_STATUS_STOPPING     ServiceStatus = "STOPPING"
+	SERVICE_STATUS_RELOADING    ServiceStatus = "RELOADING"
+	SERVICE_STATUS_UNINSTALLED  ServiceStatus = "UNINSTALLED" // only seen in the event history, the service is gone
 )
 
+// ServiceSpec describes the program behind a service. A spec without a Command is a simulated service, anything else is spawned and supervised by the panel itself.
+type ServiceSpec struct {
+	Name        string   `json:"name"`
+	Command     string   `json:"command,omitempty"`
+	Args        []string `json:"args,omitempty"`
+	Env         []string `json:"env,omitempty"` // KEY=VALUE pairs added on top of the panel environment
+	WorkingDir  string   `json:"working_dir,omitempty"`
+	User        string   `json:"user,omitempty"`
+	StopTimeout int      `json:"stop_timeout,omitempty"` // seconds between SIGTERM and SIGKILL, defaults to 10
+
+	Restart         RestartPolicy `json:"restart,omitempty"`           // no, on-failure or always, defaults to no
+	RestartDelay    int           `json:"restart_delay,omitempty"`     // seconds before the first restart, doubled on every following one
+	RestartMaxDelay int           `json:"restart_max_delay,omitempty"` // upper bound for the backoff in seconds
+	RestartLimit    int           `json:"restart_limit,omitempty"`     // restarts allowed within RestartWindow before the service is FAILED
+	RestartWindow   int           `json:"restart_window,omitempty"`    // seconds
+
+	LogMaxSize  int64 `json:"log_max_size,omitempty"`  // bytes before the log file is rotated, defaults to 10MB
+	LogMaxFiles int   `json:"log_max_files,omitempty"` // rotated files kept next to the current one, defaults to 3
+
+	HealthCheck *HealthCheckSpec `json:"health_check,omitempty"`
+	Limits      *ResourceLimits  `json:"limits,omitempty"`
+
+	Requires []string `json:"requires,omitempty"` // services started before this one and stopped after it
+	After    []string `json:"after,omitempty"`    // ordering only, the services are not pulled in
+}
+
 // general struct for services operation (exported types using Pascal Case). Also should to specify ` json tag`, or public struct will not return a valid  json value. (and are invisible to another structure using )
 type ServiceInfo struct {
 	Name   string        `json:"name"`
 	Status ServiceStatus `json:"status"` // must keep the public declaration types also, since structs variables by other data source can call
 	//we need to persist somewhere , but right now it would be volatile inside in mem structure of the struct
+	Spec      ServiceSpec   `json:"spec"`
+	PID       int           `json:"pid,omitempty"`
+	ExitCode  *int          `json:"exit_code,omitempty"`
+	StartedAt time.Time     `json:"started_at"`
+	Uptime    float64       `json:"uptime_seconds"`      // filled in when the service is read
+	Operation ServiceAction `json:"operation,omitempty"` // action in flight, holds the per service operation lock
+
+	Enabled        bool `json:"enabled"`         // started whenever the panel boots
+	DesiredRunning bool `json:"desired_running"` // what the last start or stop asked for, restored at boot
+
+	ConfigFile string `json:"config_file,omitempty"` // definition file managing the service, empty when installed by hand
+
+	Resources *ServiceResources `json:"resources,omitempty"` // usage of the process tree, supervised services only
+
+	Restarts       int       `json:"restarts"`
+	LastExitReason string    `json:"last_exit_reason,omitempty"`
+	StatusReason   string    `json:"status_reason,omitempty"` // latest resource limit hit or limit that could not be applied
+	NextRestart    time.Time `json:"next_restart"`
+
+	Health          ServiceHealth `json:"health"`
+	HealthMessage   string        `json:"health_message,omitempty"` // error of the last failed check
+	LastHealthCheck time.Time     `json:"last_health_check"`
+
+	proc          *supervisedProcess // running process for supervised services, nil otherwise
+	stopRequested bool               // set when the process is being stopped on purpose, so it is not restarted
+	restartTimes  []time.Time        // restarts inside the current window
+	restartTimer  *time.Timer
+	health        *healthMonitor
+	usage         *usageTracker
+
+	opActor   string        // who asked for the operation in flight
+	opFrom    ServiceStatus // state the operation started from
+	opStarted time.Time
+
+	statusSince time.Time // when the service settled in its current state
+}
+
+// IsSupervised reports whether the service runs a real program under the panel supervisor.
+func (s *ServiceInfo) IsSupervised() bool {
+	return s.Spec.Command != ""
+}
+
+// snapshot returns a copy of the service that is safe to hand out of the store, must be called with the store lock held.
+func (s *ServiceInfo) snapshot() ServiceInfo {
+	info := *s
+	info.proc = nil
+	info.restartTimes = nil
+	info.restartTimer = nil
+	info.health = nil
+	info.usage = nil
+	if s.Resources != nil {
+		resources := *s.Resources
+		resources.History = append([]ResourceSample(nil), s.Resources.History...)
+		info.Resources = &resources
+	}
+	if s.ExitCode != nil {
+		code := *s.ExitCode
+		info.ExitCode = &code
+	}
+	if s.PID != 0 && !s.StartedAt.IsZero() {
+		info.Uptime = time.Since(s.StartedAt).Seconds()
+	}
+	return info
 }
+
 type ServiceStore struct {
 	services map[string]*ServiceInfo
 
@@ -47,10 +146,48 @@ func InitServices() {
 		services: make(map[string]*ServiceInfo),
 	}
 
+	restoreServices()
+	go monitorServiceUsage()
+
+}
+
+// ErrInvalidService is returned when a service cannot be installed as it is described
+var ErrInvalidService = errors.New("invalid service")
+
+// serviceNamePattern keeps a name usable as a log file or cgroup name: no path separator and no leading dot
+var serviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.@-]*$`)
+
+// validateServiceName checks a name before it is used anywhere, the log and cgroup paths are built from it.
+func validateServiceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: a service name is required to install it", ErrInvalidService)
+	}
+	if !serviceNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: service name %q must start with a letter or digit and only use letters, digits, _ . @ and -", ErrInvalidService, name)
+	}
+	return nil
 }
 
 // Simulates  instalation  and  create services that will persist volatile at all steps of application(  use pascal case for this specific implementation ) also as other public struct method ( export function by rules, uppercase to see those implementations methods with that scope, all those also, if need for use them external that specific files implementation.)
-func Install(serviceName string) error {
+func Install(spec ServiceSpec, actor string) error {
+	return installSpec(spec, "", actor)
+}
+
+// installSpec registers the service, configFile is the definition file it was loaded from, if any.
+func installSpec(spec ServiceSpec, configFile string, actor string) error {
+	serviceName := spec.Name
+	if err := validateServiceName(serviceName); err != nil {
+		return err
+	}
+	if spec.Command != "" {
+		if err := validateSpec(spec); err != nil {
+			return err
+		}
+	}
+	if err := validateHealthCheck(serviceName, spec.HealthCheck); err != nil {
+		return err
+	}
+
 	serviceList.Lock()
 	defer serviceList.Unlock()
 
@@ -60,11 +197,29 @@ func Install(serviceName string) error {
 		return fmt.Errorf("the service: %v exist and cannot re install it", serviceName)
 
 	}
+	if err := validateDependencies(spec); err != nil {
+		return err
+	}
 
-	serviceList.services[serviceName] = &ServiceInfo{
+	service := &ServiceInfo{
 		Name: serviceName,
+		Spec: spec,
+
+		Status:     SERVICE_STATUS_INSTALLING,
+		Operation:  SERVICE_ACTION_INSTALL,
+		ConfigFile: configFile,
 
-		Status: SERVICE_STATUS_INSTALLING,
+		opActor:   actor,
+		opStarted: time.Now(),
+	}
+	serviceList.services[serviceName] = service
+	startHealthMonitor(service)
+	persistServices()
+
+	// a supervised program is registered right away, there is nothing to wait for
+	if service.IsSupervised() {
+		endOperation(service, SERVICE_STATUS_STOPPED)
+		return nil
 	}
 
 	go installService(serviceName)
@@ -79,6 +234,7 @@ func installService(serviceName string) {
 
 	var sec int = rand.Intn(5) + 1
 	fmt.Println("Installing service " + serviceName + "  takes  " + fmt.Sprintf("%v", sec))
+	serviceLogf(serviceName, "installing, takes %d sec", sec)
 
 	<-time.After(time.Duration(sec) * time.Second)
 
@@ -86,7 +242,7 @@ func installService(serviceName string) {
 	defer serviceList.Unlock()
 
 	if service, exist := serviceList.services[serviceName]; exist {
-		service.Status = SERVICE_STATUS_STOPPED
+		endOperation(service, SERVICE_STATUS_STOPPED)
 	}
 
 }
@@ -99,7 +255,7 @@ func GetServiceStatus(name string) (ServiceInfo, error) {
 
 	if service, ok := serviceList.services[name]; ok {
 
-		return *service, nil
+		return service.snapshot(), nil
 
 	}
 
@@ -109,26 +265,54 @@ func GetServiceStatus(name string) (ServiceInfo, error) {
 
 // simulates running specific operations of service in a period.( public func or method using Camelcase!)
 
-func Start(serviceName string) error {
+func Start(serviceName string, actor string) error {
 	serviceList.Lock()
 
 	defer serviceList.Unlock()
 
 	if service, ok := serviceList.services[serviceName]; ok {
-		if service.Status == SERVICE_STATUS_STARTED {
+		deps, err := requiredServices(serviceName)
+		if err != nil {
+			return err
+		}
+		if err := beginOperation(service, SERVICE_ACTION_START, actor); err != nil {
 
-			return errors.New(fmt.Sprintf("The service: %v,  already started, and status = STARTED", serviceName))
+			return err
 
 		}
-		go startService(service)
-
-		return nil
+		if service.IsSupervised() {
+			// a manual start begins a fresh restart history
+			resetRestarts(service)
+		}
+		service.DesiredRunning = true
+		persistServices()
+		if len(deps) > 0 {
+			go startDependencies(service, deps)
+			return nil
+		}
+		return performStart(service)
 	}
 
 	return fmt.Errorf("service by that %s is not instaled!", serviceName)
 
 }
 
+// performStart runs the start itself once the dependencies are up, must be called with the store lock held.
+func performStart(service *ServiceInfo) error {
+	if service.IsSupervised() {
+		if err := spawnService(service); err != nil {
+			service.LastExitReason = err.Error()
+			failOperation(service, SERVICE_STATUS_FAILED, err)
+			return err
+		}
+		endOperation(service, SERVICE_STATUS_STARTED)
+		return nil
+	}
+	go startService(service)
+
+	return nil
+}
+
 // simulation function of doing an actual task and setting a timer to wait to respond.(all lower cases no exports local implementation types ). Since no return structs/ type .
 func startService(service *ServiceInfo) {
 
@@ -136,30 +320,48 @@ func startService(service *ServiceInfo) {
 	var sec = rand.Intn(3) + 1
 
 	fmt.Printf("Starting   %s ,    waiting    %d   sec... \n", service.Name, sec)
+	serviceLogf(service.Name, "starting, takes %d sec", sec)
 
 	<-time.After(time.Duration(sec) * time.Second)
 
 	serviceList.Lock()
 
 	defer serviceList.Unlock()
-	service.Status = SERVICE_STATUS_STARTED
+	endOperation(service, SERVICE_STATUS_STARTED)
 
 }
 
 // simulate to stop current services and update the volatile map info for every change, like setting it stopped in general ( all  methods for internal implementation with no exports, low cases also the data variables)
-func Stop(serviceName string) error {
+func Stop(serviceName string, actor string) error {
+	return stopRequested(serviceName, actor, true)
+}
+
+// stopRequested stops a service, recording the stop as wanted only when asked for itself and not cascading from the
+// stop of a service it requires.
+func stopRequested(serviceName string, actor string, wanted bool) error {
 	serviceList.Lock()
 
 	defer serviceList.Unlock()
 	if service, ok := serviceList.services[serviceName]; ok {
 
-		if service.Status == SERVICE_STATUS_STOPPED {
+		if err := beginOperation(service, SERVICE_ACTION_STOP, actor); err != nil {
 
-			return errors.New(fmt.Sprintf(" service:  %v   , already stop", service.Name))
+			return err
 
 		}
 
-		go stopService(service)
+		if service.IsSupervised() {
+			resetRestarts(service)
+		}
+		if wanted {
+			service.DesiredRunning = false
+			persistServices()
+		}
+		if dependents := dependentServices(serviceName); len(dependents) > 0 {
+			go stopDependents(service, dependents)
+			return nil
+		}
+		performStop(service)
 
 		return nil
 	}
@@ -168,6 +370,21 @@ func Stop(serviceName string) error {
 
 }
 
+// performStop runs the stop itself once the dependents are down, must be called with the store lock held.
+func performStop(service *ServiceInfo) {
+	if service.IsSupervised() {
+		if service.proc == nil {
+			// nothing is running while waiting for a restart or after giving up
+			endOperation(service, SERVICE_STATUS_STOPPED)
+			return
+		}
+		go stopSupervised(service)
+		return
+	}
+
+	go stopService(service)
+}
+
 func stopService(service *ServiceInfo) { // if is local implementation
 
 	rand.Seed(rand.Int63())
@@ -175,23 +392,34 @@ func stopService(service *ServiceInfo) { // if is local implementation
 	var sec = rand.Intn(2) + 1
 
 	fmt.Printf("Stopping  service :  %s   ,waiting :   %d  sec ...\n", service.Name, sec)
+	serviceLogf(service.Name, "stopping, takes %d sec", sec)
 
 	<-time.After(time.Duration(sec) * time.Second)
 
 	serviceList.Lock()
 
 	defer serviceList.Unlock()
-	service.Status = SERVICE_STATUS_STOPPED
+	endOperation(service, SERVICE_STATUS_STOPPED)
 }
 
 // function that simulates service reloading for every specific call ( export implementation with pascal cases)
-func Reload(serviceName string) error {
+func Reload(serviceName string, actor string) error {
 
 	serviceList.Lock()
 	defer serviceList.Unlock()
 
 	if service, ok := serviceList.services[serviceName]; ok {
 
+		if err := beginOperation(service, SERVICE_ACTION_RELOAD, actor); err != nil {
+			return err
+		}
+
+		if service.IsSupervised() {
+			err := signalService(service, syscall.SIGHUP)
+			failOperation(service, SERVICE_STATUS_STARTED, err)
+			return err
+		}
+
 		go reloadService(service)
 		return nil
 
@@ -210,11 +438,49 @@ func reloadService(service *ServiceInfo) { //Local, use cases
 	<-time.After(time.Duration(sec) * time.Second)
 
 	fmt.Println("Service :" + service.Name + "   reloaded  successful!")
+	serviceLogf(service.Name, "reloaded after %d sec", sec)
+
+	serviceList.Lock()
+	defer serviceList.Unlock()
+	endOperation(service, SERVICE_STATUS_STARTED)
 
 }
 
+// Restart stops the service when it runs and starts it again once the stop went through, it blocks until the start was issued.
+// The dependents the stop took down are started again in order once the service is back up.
+func Restart(serviceName string, actor string) error {
+	serviceList.RLock()
+	dependents := runningDependents(serviceName)
+	serviceList.RUnlock()
+
+	if err := Stop(serviceName, actor); err != nil && !errors.Is(err, ErrInvalidTransition) {
+		return err
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	for {
+		service, err := GetServiceStatus(serviceName)
+		if err != nil {
+			return err
+		}
+		if service.Operation == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: service %s is still %s after a minute", ErrServiceBusy, serviceName, service.Operation)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := Start(serviceName, actor); err != nil {
+		return err
+	}
+	go startDependents(serviceName, dependents, actor)
+	return nil
+}
+
 // function to call an operation for uninstall operation for specified services.( public struct )
-func Uninstall(serviceName string) error {
+func Uninstall(serviceName string, actor string) error {
 
 	serviceList.Lock()
 
@@ -223,7 +489,19 @@ func Uninstall(serviceName string) error {
 	service, ok := serviceList.services[serviceName]
 
 	if ok {
-		service.Status = SERVICE_STATUS_UNINSTALLING
+		if dependents := directDependents(serviceName); len(dependents) > 0 {
+			return fmt.Errorf("%w: uninstall %s first", ErrServiceRequired, strings.Join(dependents, ", "))
+		}
+		if err := beginOperation(service, SERVICE_ACTION_UNINSTALL, actor); err != nil {
+			return err
+		}
+		persistServices()
+
+		if service.IsSupervised() {
+			resetRestarts(service)
+			go uninstallSupervised(service)
+			return nil
+		}
 
 		go unInstallService(serviceName)
 
@@ -241,6 +519,10 @@ func unInstallService(name string) { //local  struct with impl
 	serviceList.Lock()
 
 	defer serviceList.Unlock()
+	if service, exist := serviceList.services[name]; exist {
+		stopHealthMonitor(service)
+		endOperation(service, SERVICE_STATUS_UNINSTALLED)
+	}
 	delete(serviceList.services, name)
 
 	fmt.Printf("Service   %s  ,  removed successful \n", name)
@@ -255,7 +537,8 @@ func ListServices() map[string]*ServiceInfo {
 	services := make(map[string]*ServiceInfo)
 	for key, value := range serviceList.services {
 
-		services[key] = value
+		info := value.snapshot()
+		services[key] = &info
 
 	}
 	return services
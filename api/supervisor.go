@@ -0,0 +1,308 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// default grace period between SIGTERM and SIGKILL when a spec does not set one
+const defaultStopTimeout = 10 * time.Second
+
+// supervisedProcess keeps the handle of a program spawned for a service, done is closed once the process has been reaped.
+type supervisedProcess struct {
+	cmd    *exec.Cmd
+	stdout *outputWriter
+	stderr *outputWriter
+	done   chan struct{}
+
+	cgroup     string        // cgroup v2 group enforcing the limits, empty when rlimits are used
+	limits     limitCounters // counters at the last check, to report only new limit hits
+	throttling bool
+}
+
+// validateSpec checks that a supervised spec can actually be spawned before it is registered.
+func validateSpec(spec ServiceSpec) error {
+	if _, err := exec.LookPath(spec.Command); err != nil {
+		return fmt.Errorf("command %q for service %s cannot be found: %v", spec.Command, spec.Name, err)
+	}
+	for _, kv := range spec.Env {
+		if !strings.Contains(kv, "=") {
+			return fmt.Errorf("env entry %q for service %s must be KEY=VALUE", kv, spec.Name)
+		}
+	}
+	if spec.WorkingDir != "" {
+		info, err := os.Stat(spec.WorkingDir)
+		if err != nil {
+			return fmt.Errorf("working dir for service %s: %v", spec.Name, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("working dir %s for service %s is not a directory", spec.WorkingDir, spec.Name)
+		}
+	}
+	if spec.User != "" {
+		if _, err := lookupCredential(spec.User); err != nil {
+			return err
+		}
+	}
+	if err := validateLimits(spec.Name, spec.Limits); err != nil {
+		return err
+	}
+	if spec.StopTimeout < 0 {
+		return fmt.Errorf("stop timeout for service %s cannot be negative", spec.Name)
+	}
+	return validateRestart(spec)
+}
+
+// lookupCredential resolves a user name (or numeric uid) into the credential the process is started with.
+func lookupCredential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+		if err != nil {
+			return nil, fmt.Errorf("user %s cannot be resolved: %v", name, err)
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has a non numeric uid %s", name, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has a non numeric gid %s", name, u.Gid)
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// buildCommand turns the spec into an exec.Cmd running in its own process group, so signals reach the whole tree.
+func buildCommand(spec ServiceSpec) (*exec.Cmd, error) {
+	cmd := exec.Command(spec.Command, spec.Args...)
+	cmd.Dir = spec.WorkingDir
+	cmd.Env = append(os.Environ(), spec.Env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if spec.User != "" {
+		cred, err := lookupCredential(spec.User)
+		if err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr.Credential = cred
+	}
+	return cmd, nil
+}
+
+// spawnService starts the program of a supervised service, the caller settles the status. Must be called with the store lock held.
+func spawnService(service *ServiceInfo) error {
+	if service.proc != nil {
+		return fmt.Errorf("service %s already has a running process (pid %d)", service.Name, service.PID)
+	}
+
+	cmd, err := buildCommand(service.Spec)
+	if err != nil {
+		return err
+	}
+
+	output := configureServiceLog(service.Spec)
+	proc := &supervisedProcess{
+		cmd:    cmd,
+		stdout: &outputWriter{log: output, stream: LOG_STREAM_STDOUT},
+		stderr: &outputWriter{log: output, stream: LOG_STREAM_STDERR},
+		done:   make(chan struct{}),
+	}
+	cmd.Stdout = proc.stdout
+	cmd.Stderr = proc.stderr
+	service.StatusReason = ""
+
+	// the process is cloned straight into its cgroup, so no child escapes the limits
+	limits := service.Spec.Limits
+	var cgroupDir *os.File
+	if limits != nil && needsCgroup(limits) && cgroupsAvailable() {
+		dir, err := prepareCgroup(service.Name, limits)
+		if err == nil {
+			cgroupDir, err = os.Open(dir)
+		}
+		if err != nil {
+			serviceLogf(service.Name, "cgroup not available, falling back to rlimits: %v", err)
+		} else {
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = int(cgroupDir.Fd())
+			proc.cgroup = dir
+			proc.limits = readLimitCounters(dir)
+		}
+	}
+
+	if limits != nil {
+		if limits.CPUQuota > 0 && proc.cgroup == "" {
+			service.StatusReason = "cpu_quota needs cgroup v2 and root, it is not enforced"
+			serviceLogf(service.Name, "limit not applied: %s", service.StatusReason)
+		}
+		if needsRlimits(limits, proc.cgroup != "") {
+			if err := wrapWithLimits(cmd, limits, proc.cgroup != ""); err != nil {
+				serviceLogf(service.Name, "rlimits not applied: %v", err)
+			}
+		}
+	}
+
+	err = cmd.Start()
+	if cgroupDir != nil {
+		cgroupDir.Close()
+	}
+	if err != nil {
+		removeCgroup(proc.cgroup)
+		serviceLogf(service.Name, "spawn failed: %v", err)
+		return fmt.Errorf("spawning service %s: %v", service.Name, err)
+	}
+
+	service.proc = proc
+	service.stopRequested = false
+	service.PID = cmd.Process.Pid
+	service.ExitCode = nil
+	service.StartedAt = time.Now()
+
+	log.Printf("Service %s started with pid %d", service.Name, service.PID)
+	serviceLogf(service.Name, "started with pid %d", service.PID)
+
+	go waitService(service, proc)
+	return nil
+}
+
+// waitService reaps the process and records how it ended.
+func waitService(service *ServiceInfo, proc *supervisedProcess) {
+	err := proc.cmd.Wait()
+	code := exitCodeOf(proc.cmd, err)
+	proc.stdout.flush()
+	proc.stderr.flush()
+
+	serviceList.Lock()
+	defer serviceList.Unlock()
+	defer close(proc.done)
+
+	if service.proc != proc {
+		removeCgroup(proc.cgroup)
+		return
+	}
+
+	oomKilled := false
+	if proc.cgroup != "" {
+		counters := readLimitCounters(proc.cgroup)
+		oomKilled = counters.oomKills > proc.limits.oomKills
+		reportLimitHits(service, counters)
+		removeCgroup(proc.cgroup)
+	}
+
+	service.proc = nil
+	service.PID = 0
+	service.ExitCode = &code
+	service.usage = nil
+	if service.Resources != nil {
+		// the history stays around to see what happened before the exit
+		service.Resources.Current = ResourceSample{Time: time.Now()}
+	}
+	service.LastExitReason = exitReasonOf(proc.cmd, code)
+	if oomKilled {
+		service.LastExitReason += " after hitting memory_max"
+	}
+
+	log.Printf("Service %s %s", service.Name, service.LastExitReason)
+	serviceLogf(service.Name, "%s", service.LastExitReason)
+
+	// a stop or uninstall in flight settles the status itself
+	if service.stopRequested {
+		return
+	}
+	scheduleRestart(service, code)
+}
+
+// exitCodeOf returns the exit code of a finished command, signals are reported shell style as 128+signal.
+func exitCodeOf(cmd *exec.Cmd, err error) int {
+	if cmd.ProcessState == nil {
+		return -1
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return -1
+	}
+	return cmd.ProcessState.ExitCode()
+}
+
+// exitReasonOf describes how a process ended in the way it is shown in the API.
+func exitReasonOf(cmd *exec.Cmd, code int) string {
+	if cmd.ProcessState != nil {
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return fmt.Sprintf("killed by signal %v", status.Signal())
+		}
+	}
+	return fmt.Sprintf("exited with code %d", code)
+}
+
+// signalService delivers sig to the process group of a running supervised service, must be called with the store lock held.
+func signalService(service *ServiceInfo, sig syscall.Signal) error {
+	if service.proc == nil {
+		return fmt.Errorf("service %s is not running", service.Name)
+	}
+	if err := syscall.Kill(-service.PID, sig); err != nil {
+		return fmt.Errorf("sending %v to service %s: %v", sig, service.Name, err)
+	}
+	return nil
+}
+
+// terminateService sends SIGTERM and escalates to SIGKILL once the stop timeout expires, it blocks until the process is gone.
+func terminateService(service *ServiceInfo) {
+	serviceList.Lock()
+	proc := service.proc
+	if proc == nil {
+		serviceList.Unlock()
+		return
+	}
+	pid := service.PID
+	service.stopRequested = true
+	timeout := defaultStopTimeout
+	if service.Spec.StopTimeout > 0 {
+		timeout = time.Duration(service.Spec.StopTimeout) * time.Second
+	}
+	serviceList.Unlock()
+
+	log.Printf("Stopping service %s (pid %d)", service.Name, pid)
+	syscall.Kill(-pid, syscall.SIGTERM)
+
+	select {
+	case <-proc.done:
+	case <-time.After(timeout):
+		log.Printf("Service %s did not stop within %s, killing it", service.Name, timeout)
+		syscall.Kill(-pid, syscall.SIGKILL)
+		<-proc.done
+	}
+}
+
+// stopSupervised terminates the process and releases the stop operation.
+func stopSupervised(service *ServiceInfo) {
+	terminateService(service)
+
+	serviceList.Lock()
+	defer serviceList.Unlock()
+	endOperation(service, SERVICE_STATUS_STOPPED)
+}
+
+// uninstallSupervised stops the program if needed and removes the service from the store.
+func uninstallSupervised(service *ServiceInfo) {
+	terminateService(service)
+
+	serviceList.Lock()
+	defer serviceList.Unlock()
+	if serviceList.services[service.Name] == service {
+		stopHealthMonitor(service)
+		endOperation(service, SERVICE_STATUS_UNINSTALLED)
+		delete(serviceList.services, service.Name)
+	}
+	log.Printf("Service %s removed", service.Name)
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TaskActionType is a panel operation a task can run instead of a command.
+type TaskActionType string
+
+const (
+	TASK_ACTION_SERVICE          TaskActionType = "service"          // start, stop, restart or reload a service
+	TASK_ACTION_METRICS_SNAPSHOT TaskActionType = "metrics_snapshot" // write the current metrics to a JSON file
+	TASK_ACTION_NOTIFY           TaskActionType = "notify"           // post a message to a webhook
+)
+
+// ACTOR_TASK prefixes the actor of the service operations done by a task, followed by the task id
+const ACTOR_TASK = "task"
+
+// TaskServiceSettleTime is how long a service started by a task has to stay up for the start to count, so a
+// program exiting during its startup fails the task.
+var TaskServiceSettleTime = 2 * time.Second
+
+// MetricsSnapshotDir is where metrics snapshots go when their task does not set a path.
+var MetricsSnapshotDir = filepath.Join("data", "metrics")
+
+// TaskAction is the panel operation of a task, the fields used depend on its type.
+type TaskAction struct {
+	Type      TaskActionType `json:"type"`
+	Service   string         `json:"service,omitempty"`
+	Operation ServiceAction  `json:"operation,omitempty"` // start, stop, restart or reload
+	Path      string         `json:"path,omitempty"`      // snapshot file, a timestamped file in MetricsSnapshotDir when empty
+	URL       string         `json:"url,omitempty"`       // webhook, NotificationWebhookURL when empty
+	Title     string         `json:"title,omitempty"`
+	Message   string         `json:"message,omitempty"`
+}
+
+// validateTaskAction checks that an action has what its type needs.
+func validateTaskAction(action *TaskAction) error {
+	switch action.Type {
+	case TASK_ACTION_SERVICE:
+		switch action.Operation {
+		case SERVICE_ACTION_START, SERVICE_ACTION_STOP, SERVICE_ACTION_RESTART, SERVICE_ACTION_RELOAD:
+		default:
+			return fmt.Errorf("%w: service operation %q must be one of start, stop, restart or reload", ErrInvalidTask, action.Operation)
+		}
+		if _, err := GetServiceStatus(action.Service); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTask, err)
+		}
+	case TASK_ACTION_METRICS_SNAPSHOT:
+	case TASK_ACTION_NOTIFY:
+		if action.Message == "" {
+			return fmt.Errorf("%w: a notification needs a message", ErrInvalidTask)
+		}
+		if action.URL == "" && NotificationWebhookURL == "" {
+			return fmt.Errorf("%w: a notification needs a url, no default webhook is configured", ErrInvalidTask)
+		}
+	default:
+		return fmt.Errorf("%w: unknown action type %q, expected service, metrics_snapshot or notify", ErrInvalidTask, action.Type)
+	}
+	return nil
+}
+
+// runServiceAction does a service operation on behalf of a task, the service events name the task as actor.
+func runServiceAction(action *TaskAction, actor string) error {
+	switch action.Operation {
+	case SERVICE_ACTION_START:
+		return Start(action.Service, actor)
+	case SERVICE_ACTION_STOP:
+		return Stop(action.Service, actor)
+	case SERVICE_ACTION_RELOAD:
+		return Reload(action.Service, actor)
+	}
+	return Restart(action.Service, actor)
+}
+
+// waitServiceSettled waits for a service operation of a task to end and checks where the service ended: STOPPED
+// for a stop, STARTED for the others and still up without a restart after TaskServiceSettleTime.
+func waitServiceSettled(ctx context.Context, action *TaskAction) (ServiceInfo, error) {
+	want := SERVICE_STATUS_STARTED
+	if action.Operation == SERVICE_ACTION_STOP {
+		want = SERVICE_STATUS_STOPPED
+	}
+	var upSince time.Time
+	restarts := 0
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		service, err := GetServiceStatus(action.Service)
+		if err != nil {
+			return service, err
+		}
+		if service.Operation == "" {
+			if service.Status != want {
+				reason := service.LastExitReason
+				if reason == "" {
+					reason = "no reason recorded"
+				}
+				return service, fmt.Errorf("%s of service %s ended with the service %s instead of %s: %s",
+					action.Operation, action.Service, service.Status, want, reason)
+			}
+			if want == SERVICE_STATUS_STOPPED {
+				return service, nil
+			}
+			if upSince.IsZero() {
+				upSince, restarts = time.Now(), service.Restarts
+			}
+			if service.Restarts != restarts {
+				return service, fmt.Errorf("service %s restarted within %s of its %s: %s",
+					action.Service, TaskServiceSettleTime, action.Operation, service.LastExitReason)
+			}
+			if time.Since(upSince) >= TaskServiceSettleTime {
+				return service, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return service, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeMetricsSnapshot collects the metrics and writes them as JSON, it returns the file written.
+func writeMetricsSnapshot(path string) (string, error) {
+	metrics, err := GetMetrics()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		path = filepath.Join(MetricsSnapshotDir, "metrics-"+time.Now().UTC().Format("20060102T150405Z")+".json")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, writeFileAtomic(path, data)
+}
+
+// doTaskAction runs the panel operation of an action and tells what it did.
+func doTaskAction(ctx context.Context, action *TaskAction, actor string) (string, error) {
+	switch action.Type {
+	case TASK_ACTION_SERVICE:
+		if err := runServiceAction(action, actor); err != nil {
+			return "", err
+		}
+		// the supervisor only accepts the operation, the task reports how it ended
+		service, err := waitServiceSettled(ctx, action)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s of service %s by %s done, the service is %s", action.Operation, action.Service, actor, service.Status), nil
+	case TASK_ACTION_METRICS_SNAPSHOT:
+		path, err := writeMetricsSnapshot(action.Path)
+		if err != nil {
+			return "", err
+		}
+		return "metrics written to " + path, nil
+	case TASK_ACTION_NOTIFY:
+		url := action.URL
+		if url == "" {
+			url = NotificationWebhookURL
+		}
+		if err := sendNotification(ctx, url, Notification{Time: time.Now(), Source: actor, Title: action.Title, Message: action.Message}); err != nil {
+			return "", err
+		}
+		return "notification sent to " + url, nil
+	}
+	return "", fmt.Errorf("unknown action type %q", action.Type)
+}
+
+// runTaskAction runs the panel operation of a task, what it did goes to its stdout. The timeout and a cancel
+// end the task but cannot take back an operation that is already under way.
+func runTaskAction(ctx context.Context, taskID int, spec TaskSpec, out *taskOutput) taskResult {
+	result := taskResult{
+		stdout: &cappedBuffer{limit: taskOutputLimit},
+		stderr: &cappedBuffer{limit: taskOutputLimit},
+	}
+
+	if spec.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(spec.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	type outcome struct {
+		message string
+		err     error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		message, err := doTaskAction(ctx, spec.Action, fmt.Sprintf("%s:%d", ACTOR_TASK, taskID))
+		done <- outcome{message, err}
+	}()
+
+	var ended outcome
+	select {
+	case ended = <-done:
+	case <-ctx.Done():
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result.status = TASK_STATUS_TIMED_OUT
+		result.err = fmt.Sprintf("timed out after %ds, the %s action may still complete", spec.Timeout, spec.Action.Type)
+	case errors.Is(ctx.Err(), context.Canceled):
+		result.status = TASK_STATUS_CANCELLED
+		result.err = "cancelled while running"
+	case ended.err != nil:
+		result.status = TASK_STATUS_FAILED
+		result.err = ended.err.Error()
+		fmt.Fprintln(&taskStreamWriter{buf: result.stderr, out: out, stream: LOG_STREAM_STDERR}, ended.err)
+	default:
+		result.status = TASK_STATUS_SUCCEEDED
+		fmt.Fprintln(&taskStreamWriter{buf: result.stdout, out: out, stream: LOG_STREAM_STDOUT}, ended.message)
+	}
+	return result
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TaskHistoryDir keeps one file per finished task with its attempts and output, so the history survives restarts.
+var TaskHistoryDir = filepath.Join("data", "task-history")
+
+// retention of the finished tasks and workflows, zero keeps them without limit
+var (
+	TaskHistoryMaxAge   = 30 * 24 * time.Hour
+	TaskHistoryMaxCount = 1000
+)
+
+// TaskHistoryPruneInterval is how often finished tasks older than TaskHistoryMaxAge are looked for.
+var TaskHistoryPruneInterval = time.Hour
+
+// taskHistoryFile is where a finished task is saved.
+func taskHistoryFile(id int) string {
+	return filepath.Join(TaskHistoryDir, strconv.Itoa(id)+".json")
+}
+
+// saveTaskHistory writes a task that just finished to the history and prunes the oldest ones past the count limit.
+// Must be called with the store lock held.
+func saveTaskHistory(task *Task) {
+	data, err := json.MarshalIndent(task, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding task %d: %v", task.ID, err)
+		return
+	}
+	if err := os.MkdirAll(TaskHistoryDir, 0755); err != nil {
+		log.Printf("Error creating task history %s: %v", TaskHistoryDir, err)
+		return
+	}
+	if err := writeFileAtomic(taskHistoryFile(task.ID), data); err != nil {
+		log.Printf("Error writing task %d to the history: %v", task.ID, err)
+	}
+	pruneTaskHistory(time.Now(), false)
+}
+
+// removeTaskHistory forgets a finished task in memory and on disk, must be called with the store lock held.
+func removeTaskHistory(id int) {
+	delete(tasks.tasks, id)
+	if err := os.Remove(taskHistoryFile(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error removing task %d from the history: %v", id, err)
+	}
+}
+
+// pruneTaskHistory removes the finished tasks past the count limit and, when byAge is set, the ones that finished
+// before the age limit. The steps of workflows still running are kept, finished workflows follow the age limit.
+// Must be called with the store lock held.
+func pruneTaskHistory(now time.Time, byAge bool) int {
+	finished := make([]*Task, 0)
+	for _, task := range tasks.tasks {
+		if wf, ok := tasks.workflows[task.Workflow]; ok && wf.Status == WORKFLOW_STATUS_RUNNING {
+			continue
+		}
+		if task.IsFinished {
+			finished = append(finished, task)
+		}
+	}
+	if !byAge && (TaskHistoryMaxCount <= 0 || len(finished) <= TaskHistoryMaxCount) {
+		return 0
+	}
+	// newest first, what is left past the limits goes
+	sort.Slice(finished, func(i, j int) bool {
+		if !finished[i].FinishedAt.Equal(finished[j].FinishedAt) {
+			return finished[i].FinishedAt.After(finished[j].FinishedAt)
+		}
+		return finished[i].ID > finished[j].ID
+	})
+
+	pruned := 0
+	for i, task := range finished {
+		tooMany := TaskHistoryMaxCount > 0 && i >= TaskHistoryMaxCount
+		tooOld := byAge && TaskHistoryMaxAge > 0 && now.Sub(task.FinishedAt) > TaskHistoryMaxAge
+		if tooMany || tooOld {
+			removeTaskHistory(task.ID)
+			pruned++
+		}
+	}
+
+	if byAge && TaskHistoryMaxAge > 0 {
+		removed := false
+		for id, wf := range tasks.workflows {
+			if wf.Status != WORKFLOW_STATUS_RUNNING && now.Sub(wf.FinishedAt) > TaskHistoryMaxAge {
+				delete(tasks.workflows, id)
+				removed = true
+			}
+		}
+		if removed {
+			persistTasks()
+		}
+	}
+	return pruned
+}
+
+// runTaskHistoryPruner removes the finished tasks that got too old, for a panel that runs few tasks.
+func runTaskHistoryPruner() {
+	ticker := time.NewTicker(TaskHistoryPruneInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		tasks.Lock()
+		if pruned := pruneTaskHistory(time.Now(), true); pruned > 0 {
+			log.Printf("Pruned %d finished tasks from the history", pruned)
+		}
+		tasks.Unlock()
+	}
+}
+
+// restoreTaskHistory loads the finished tasks saved by previous runs of the panel, they are pruned by InitTasks once
+// the workflows they belong to are restored.
+func restoreTaskHistory() {
+	entries, err := os.ReadDir(TaskHistoryDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading task history %s: %v", TaskHistoryDir, err)
+		return
+	}
+
+	tasks.Lock()
+	defer tasks.Unlock()
+
+	restored := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(TaskHistoryDir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Error reading task history %s: %v", path, err)
+			continue
+		}
+		task := &Task{}
+		if err := json.Unmarshal(data, task); err != nil {
+			log.Printf("Error decoding task history %s: %v", path, err)
+			continue
+		}
+		task.queueIndex, task.readyIndex = -1, -1
+		tasks.tasks[task.ID] = task
+		if task.ID >= tasks.nextID {
+			tasks.nextID = task.ID + 1
+		}
+		restored++
+	}
+	log.Printf("Restored %d finished tasks from %s", restored, TaskHistoryDir)
+}
+
+// interruptTask ends a task that was running when the panel stopped, its command did not survive the panel.
+// Must be called with the store lock held.
+func interruptTask(task *Task) {
+	task.Status = TASK_STATUS_FAILED
+	task.Error = fmt.Sprintf("interrupted, the panel stopped while it was running since %s", task.StartedAt.Format(time.RFC3339))
+	task.FinishedAt = time.Now()
+	task.IsFinished = true
+	task.queueIndex, task.readyIndex = -1, -1
+	tasks.tasks[task.ID] = task
+	saveTaskHistory(task)
+	log.Printf("Task %d (%s) was interrupted by the panel restart", task.ID, task.Description)
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TaskOutputChunk is a piece of stdout or stderr of a task, in the order the command wrote it.
+type TaskOutputChunk struct {
+	Time    time.Time `json:"time"`
+	Attempt int       `json:"attempt"`
+	Stream  string    `json:"stream"` // stdout or stderr
+	Text    string    `json:"text"`
+}
+
+// taskOutput is the output of the current attempt of a task that has not finished, plus the followers waiting
+// for more. Followers get every byte the command writes, while only the bytes kept by the output cap are recorded
+// for the replay, so a replay matches what the task keeps.
+type taskOutput struct {
+	sync.Mutex
+
+	attempt     int
+	chunks      []TaskOutputChunk
+	subscribers map[chan TaskOutputChunk]struct{}
+	closed      bool
+}
+
+func newTaskOutput() *taskOutput {
+	return &taskOutput{subscribers: make(map[chan TaskOutputChunk]struct{})}
+}
+
+// startAttempt forgets the output of the previous attempt, which stays in the attempts of the task.
+func (o *taskOutput) startAttempt(attempt int) {
+	o.Lock()
+	defer o.Unlock()
+	o.attempt = attempt
+	o.chunks = nil
+}
+
+// record hands a chunk to the followers and keeps the first kept bytes of it for the replay.
+func (o *taskOutput) record(stream string, p []byte, kept int) {
+	o.Lock()
+	defer o.Unlock()
+
+	chunk := TaskOutputChunk{Time: time.Now(), Attempt: o.attempt, Stream: stream, Text: string(p)}
+	if kept == len(p) {
+		o.chunks = append(o.chunks, chunk)
+	} else if kept > 0 {
+		o.chunks = append(o.chunks, TaskOutputChunk{Time: chunk.Time, Attempt: chunk.Attempt, Stream: stream, Text: string(p[:kept])})
+	}
+	for ch := range o.subscribers {
+		select {
+		case ch <- chunk:
+		default: // a slow follower misses chunks rather than blocking the command
+		}
+	}
+}
+
+// subscribe returns the chunks recorded so far and registers a follower for the next ones, the returned function
+// removes it again.
+func (o *taskOutput) subscribe() ([]TaskOutputChunk, chan TaskOutputChunk, func()) {
+	ch := make(chan TaskOutputChunk, 256)
+
+	o.Lock()
+	defer o.Unlock()
+	replay := append([]TaskOutputChunk(nil), o.chunks...)
+	if o.closed {
+		close(ch)
+		return replay, ch, func() {}
+	}
+	o.subscribers[ch] = struct{}{}
+
+	return replay, ch, func() {
+		o.Lock()
+		defer o.Unlock()
+		if _, ok := o.subscribers[ch]; ok {
+			delete(o.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends the streams of every follower once the task finished.
+func (o *taskOutput) close() {
+	o.Lock()
+	defer o.Unlock()
+	o.closed = true
+	for ch := range o.subscribers {
+		delete(o.subscribers, ch)
+		close(ch)
+	}
+}
+
+// taskStreamWriter captures one stream of a task command up to the output cap and hands all of it to the followers.
+type taskStreamWriter struct {
+	buf    *cappedBuffer
+	out    *taskOutput
+	stream string
+}
+
+func (w *taskStreamWriter) Write(p []byte) (int, error) {
+	before := w.buf.buf.Len()
+	n, err := w.buf.Write(p)
+	if len(p) > 0 && w.out != nil {
+		w.out.record(w.stream, p, w.buf.buf.Len()-before)
+	}
+	return n, err
+}
+
+// finishTaskOutput ends the followers of a task that finished, must be called with the store lock held.
+func finishTaskOutput(task *Task) {
+	if task.output != nil {
+		task.output.close()
+		task.output = nil
+	}
+}
+
+// FollowTaskOutput returns the output of a task captured so far and, while the task has not finished, a channel
+// receiving the next chunks. The channel is closed once the task finished or the returned stop function is called.
+// The output of a finished task comes from its last attempt, stdout first.
+func FollowTaskOutput(taskID int) ([]TaskOutputChunk, <-chan TaskOutputChunk, func(), error) {
+	tasks.Lock()
+	defer tasks.Unlock()
+
+	task, ok := tasks.tasks[taskID]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("%w: no task with id %d", ErrTaskNotFound, taskID)
+	}
+
+	if task.IsFinished {
+		replay := make([]TaskOutputChunk, 0, 2)
+		for _, stream := range []struct{ name, text string }{{LOG_STREAM_STDOUT, task.Stdout}, {LOG_STREAM_STDERR, task.Stderr}} {
+			if stream.text != "" {
+				replay = append(replay, TaskOutputChunk{Time: task.FinishedAt, Attempt: len(task.Attempts), Stream: stream.name, Text: stream.text})
+			}
+		}
+		ch := make(chan TaskOutputChunk)
+		close(ch)
+		return replay, ch, func() {}, nil
+	}
+
+	// a task that has not started yet gets its output now so it can be followed from its first byte
+	if task.output == nil {
+		task.output = newTaskOutput()
+	}
+	replay, ch, stop := task.output.subscribe()
+	return replay, ch, stop, nil
+}
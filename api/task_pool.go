@@ -0,0 +1,181 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DEFAULT_TASK_QUEUE is the queue of tasks that do not name one
+const DEFAULT_TASK_QUEUE = "default"
+
+// TaskMaxConcurrency is how many task commands run at the same time when the pool settings were never changed.
+var TaskMaxConcurrency = 4
+
+// TaskPool is the configuration and the load of the worker pool running the due tasks.
+type TaskPool struct {
+	MaxConcurrency int                      `json:"max_concurrency"`
+	Running        int                      `json:"running"`
+	Waiting        int                      `json:"waiting"`
+	Queues         map[string]TaskQueueInfo `json:"queues"`
+}
+
+// TaskQueueInfo is the limit and the load of one named queue, a zero limit only leaves the pool limit.
+type TaskQueueInfo struct {
+	MaxConcurrency int `json:"max_concurrency"`
+	Running        int `json:"running"`
+	Waiting        int `json:"waiting"`
+}
+
+// TaskPoolSettings changes the pool, queues missing from Queues keep their limit.
+type TaskPoolSettings struct {
+	MaxConcurrency int            `json:"max_concurrency,omitempty"`
+	Queues         map[string]int `json:"queues,omitempty"`
+}
+
+// taskPool keeps the due tasks waiting for a worker, ordered by priority then by the time they became due.
+type taskPool struct {
+	maxConcurrency int
+	queueLimits    map[string]int
+	ready          []*Task
+	running        int
+	queueRunning   map[string]int
+}
+
+// queueOf returns the queue of a task.
+func queueOf(task *Task) string {
+	if task.Queue == "" {
+		return DEFAULT_TASK_QUEUE
+	}
+	return task.Queue
+}
+
+// readyBefore orders the waiting tasks, higher priority first then first come first served.
+func readyBefore(a, b *Task) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if !a.QueuedAt.Equal(b.QueuedAt) {
+		return a.QueuedAt.Before(b.QueuedAt)
+	}
+	return a.ID < b.ID
+}
+
+// renumberReady refreshes the position every waiting task keeps of itself, must be called with the store lock held.
+func renumberReady() {
+	for i, task := range tasks.pool.ready {
+		task.readyIndex = i
+	}
+}
+
+// enqueueTask hands a due task to the pool, it starts as soon as a worker of its queue is free.
+// Must be called with the store lock held.
+func enqueueTask(task *Task) {
+	pool := &tasks.pool
+	task.QueuedAt = time.Now()
+	i := sort.Search(len(pool.ready), func(i int) bool { return readyBefore(task, pool.ready[i]) })
+	pool.ready = append(pool.ready, nil)
+	copy(pool.ready[i+1:], pool.ready[i:])
+	pool.ready[i] = task
+	renumberReady()
+	pumpTasks()
+}
+
+// removeReady takes a task out of the pool before it started, must be called with the store lock held.
+func removeReady(task *Task) bool {
+	if task.readyIndex < 0 {
+		return false
+	}
+	pool := &tasks.pool
+	pool.ready = append(pool.ready[:task.readyIndex], pool.ready[task.readyIndex+1:]...)
+	task.readyIndex = -1
+	renumberReady()
+	return true
+}
+
+// pumpTasks starts waiting tasks while workers are free, a task whose queue is full lets the next ones pass.
+// Must be called with the store lock held.
+func pumpTasks() {
+	pool := &tasks.pool
+	for i := 0; i < len(pool.ready) && pool.running < pool.maxConcurrency; {
+		task := pool.ready[i]
+		queue := queueOf(task)
+		if limit := pool.queueLimits[queue]; limit > 0 && pool.queueRunning[queue] >= limit {
+			i++
+			continue
+		}
+		removeReady(task)
+		pool.running++
+		pool.queueRunning[queue]++
+		launchTask(task)
+	}
+}
+
+// releaseWorker frees the worker of a task that finished and starts the next ones, must be called with the store lock held.
+func releaseWorker(task *Task) {
+	pool := &tasks.pool
+	pool.running--
+	pool.queueRunning[queueOf(task)]--
+	pumpTasks()
+}
+
+// GetTaskPool returns the pool settings with the number of running and waiting tasks of every queue.
+func GetTaskPool() TaskPool {
+	tasks.RLock()
+	defer tasks.RUnlock()
+
+	pool := &tasks.pool
+	info := TaskPool{
+		MaxConcurrency: pool.maxConcurrency,
+		Running:        pool.running,
+		Waiting:        len(pool.ready),
+		Queues:         make(map[string]TaskQueueInfo),
+	}
+	for name, limit := range pool.queueLimits {
+		info.Queues[name] = TaskQueueInfo{MaxConcurrency: limit}
+	}
+	for name, running := range pool.queueRunning {
+		if running > 0 {
+			queue := info.Queues[name]
+			queue.Running = running
+			info.Queues[name] = queue
+		}
+	}
+	for _, task := range pool.ready {
+		queue := info.Queues[queueOf(task)]
+		queue.Waiting++
+		info.Queues[queueOf(task)] = queue
+	}
+	return info
+}
+
+// ConfigureTaskPool changes the pool limit and queue limits, a queue limit of zero removes it.
+// Lowering a limit never stops running tasks, it only holds back the next ones.
+func ConfigureTaskPool(settings TaskPoolSettings) (TaskPool, error) {
+	if settings.MaxConcurrency < 0 {
+		return TaskPool{}, fmt.Errorf("%w: max_concurrency cannot be negative", ErrInvalidTask)
+	}
+	for name, limit := range settings.Queues {
+		if limit < 0 {
+			return TaskPool{}, fmt.Errorf("%w: limit of queue %s cannot be negative", ErrInvalidTask, name)
+		}
+	}
+
+	tasks.Lock()
+	pool := &tasks.pool
+	if settings.MaxConcurrency > 0 {
+		pool.maxConcurrency = settings.MaxConcurrency
+	}
+	for name, limit := range settings.Queues {
+		if limit == 0 {
+			delete(pool.queueLimits, name)
+		} else {
+			pool.queueLimits[name] = limit
+		}
+	}
+	pumpTasks()
+	persistTasks()
+	tasks.Unlock()
+
+	return GetTaskPool(), nil
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestTaskStore gives a test an empty task store writing its files to a temporary directory. The tasks
+// left running or waiting are cancelled when the test ends.
+func useTestTaskStore(t *testing.T, maxConcurrency int) {
+	t.Helper()
+	dir := t.TempDir()
+	savedStore, savedState, savedHistory := tasks, TaskStateFile, TaskHistoryDir
+	TaskStateFile = filepath.Join(dir, "tasks.json")
+	TaskHistoryDir = filepath.Join(dir, "task-history")
+	tasks = &TaskStore{
+		tasks:          make(map[int]*Task),
+		wake:           make(chan struct{}, 1),
+		recurring:      make(map[string]*RecurringTask),
+		workflows:      make(map[int]*Workflow),
+		nextWorkflowID: 1,
+		pool: taskPool{
+			maxConcurrency: maxConcurrency,
+			queueLimits:    make(map[string]int),
+			queueRunning:   make(map[string]int),
+		},
+	}
+
+	t.Cleanup(func() {
+		tasks.Lock()
+		for _, task := range append([]*Task(nil), tasks.pool.ready...) {
+			stopTask(task)
+		}
+		for _, task := range tasks.tasks {
+			if task.Status == TASK_STATUS_RUNNING {
+				stopTask(task)
+			}
+		}
+		tasks.Unlock()
+		// the commands that were killed have to be done with the store before it goes
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			tasks.RLock()
+			running := tasks.pool.running
+			tasks.RUnlock()
+			if running == 0 {
+				break
+			}
+		}
+		tasks, TaskStateFile, TaskHistoryDir = savedStore, savedState, savedHistory
+	})
+}
+
+// addPoolTask stores a task that sleeps until it is cancelled and hands it to the pool.
+// Must be called with the store lock held.
+func addPoolTask(name, queue string, priority int) *Task {
+	task := &Task{
+		TaskSpec:   TaskSpec{Description: name, Command: []string{"sleep", "30"}, Queue: queue, Priority: priority},
+		ID:         nextTaskID(),
+		Status:     TASK_STATUS_PENDING,
+		queueIndex: -1,
+		readyIndex: -1,
+	}
+	tasks.tasks[task.ID] = task
+	enqueueTask(task)
+	return task
+}
+
+// readyNames returns the descriptions of the tasks waiting for a worker, checking the index each keeps of itself.
+// Must be called with the store lock held.
+func readyNames(t *testing.T) []string {
+	t.Helper()
+	names := make([]string, len(tasks.pool.ready))
+	for i, task := range tasks.pool.ready {
+		if task.readyIndex != i {
+			t.Errorf("task %s is at %d of the pool but keeps index %d", task.Description, i, task.readyIndex)
+		}
+		names[i] = task.Description
+	}
+	return names
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitStatus polls a task until it reaches status.
+func waitStatus(t *testing.T, task *Task, status TaskStatus) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		tasks.RLock()
+		got := task.Status
+		tasks.RUnlock()
+		if got == status {
+			return
+		}
+	}
+	t.Fatalf("task %s never became %s", task.Description, status)
+}
+
+func TestTaskPoolPriorityOrder(t *testing.T) {
+	useTestTaskStore(t, 1)
+
+	tasks.Lock()
+	blocker := addPoolTask("blocker", "", 0)
+	addPoolTask("low", "", 0)
+	addPoolTask("high", "", 10)
+	addPoolTask("mid", "", 5)
+	addPoolTask("high-later", "", 10)
+	addPoolTask("negative", "", -1)
+	addPoolTask("low-later", "", 0)
+	if blocker.Status != TASK_STATUS_RUNNING {
+		t.Errorf("blocker is %s, want it to take the free worker", blocker.Status)
+	}
+	want := []string{"high", "high-later", "mid", "low", "low-later", "negative"}
+	if got := readyNames(t); !equalNames(got, want) {
+		t.Errorf("waiting %v, want %v", got, want)
+	}
+	high := tasks.pool.ready[0]
+	stopTask(blocker)
+	tasks.Unlock()
+
+	// the worker freed by the blocker goes to the highest priority
+	waitStatus(t, high, TASK_STATUS_RUNNING)
+	tasks.RLock()
+	defer tasks.RUnlock()
+	if got := readyNames(t); !equalNames(got, want[1:]) {
+		t.Errorf("waiting %v after the blocker ended, want %v", got, want[1:])
+	}
+}
+
+func TestTaskPoolQueueLimit(t *testing.T) {
+	useTestTaskStore(t, 3)
+
+	tasks.Lock()
+	tasks.pool.queueLimits["backup"] = 1
+	first := addPoolTask("backup-1", "backup", 0)
+	second := addPoolTask("backup-2", "backup", 5)
+	other := addPoolTask("report", "", 0)
+	extra := addPoolTask("report-2", "reports", 0)
+	late := addPoolTask("report-3", "", 0)
+
+	// a full queue lets the tasks of the other queues pass, the pool limit still applies to all
+	for _, tt := range []struct {
+		task *Task
+		want TaskStatus
+	}{{first, TASK_STATUS_RUNNING}, {second, TASK_STATUS_PENDING}, {other, TASK_STATUS_RUNNING},
+		{extra, TASK_STATUS_RUNNING}, {late, TASK_STATUS_PENDING}} {
+		if tt.task.Status != tt.want {
+			t.Errorf("%s is %s, want %s", tt.task.Description, tt.task.Status, tt.want)
+		}
+	}
+	if running := tasks.pool.queueRunning["backup"]; running != 1 {
+		t.Errorf("%d backup tasks running, want 1", running)
+	}
+	if want := []string{"backup-2", "report-3"}; !equalNames(readyNames(t), want) {
+		t.Errorf("waiting %v, want %v", readyNames(t), want)
+	}
+
+	// a worker freed outside the backup queue goes to the next task that may run, not to backup-2
+	stopTask(other)
+	tasks.Unlock()
+	waitStatus(t, late, TASK_STATUS_RUNNING)
+
+	tasks.Lock()
+	if second.Status != TASK_STATUS_PENDING {
+		t.Errorf("backup-2 is %s while backup-1 still runs", second.Status)
+	}
+	stopTask(first)
+	tasks.Unlock()
+	waitStatus(t, second, TASK_STATUS_RUNNING)
+}
+
+func TestTaskPoolCancelQueued(t *testing.T) {
+	useTestTaskStore(t, 1)
+
+	tasks.Lock()
+	blocker := addPoolTask("blocker", "", 0)
+	first := addPoolTask("a", "", 0)
+	queued := addPoolTask("b", "", 0)
+	last := addPoolTask("c", "", 0)
+
+	stopTask(queued)
+	if queued.Status != TASK_STATUS_CANCELLED || !queued.IsFinished || queued.readyIndex != -1 {
+		t.Errorf("cancelled task is %s, finished %v, index %d", queued.Status, queued.IsFinished, queued.readyIndex)
+	}
+	if want := []string{"a", "c"}; !equalNames(readyNames(t), want) {
+		t.Errorf("waiting %v after cancelling b, want %v", readyNames(t), want)
+	}
+	if tasks.pool.running != 1 {
+		t.Errorf("%d tasks running, cancelling a waiting task must not free a worker", tasks.pool.running)
+	}
+	// cancelling it again is harmless and it never starts
+	if removeReady(queued) {
+		t.Error("a cancelled task was still in the pool")
+	}
+	stopTask(blocker)
+	tasks.Unlock()
+
+	waitStatus(t, first, TASK_STATUS_RUNNING)
+	tasks.Lock()
+	stopTask(first)
+	tasks.Unlock()
+	waitStatus(t, last, TASK_STATUS_RUNNING)
+	tasks.RLock()
+	defer tasks.RUnlock()
+	if queued.Status != TASK_STATUS_CANCELLED {
+		t.Errorf("cancelled task is %s once the pool moved on", queued.Status)
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"container/heap"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// RetryBackoff is how the delay between two attempts of a task grows.
+type RetryBackoff string
+
+const (
+	RETRY_BACKOFF_FIXED       RetryBackoff = "fixed"       // retry_delay every time
+	RETRY_BACKOFF_EXPONENTIAL RetryBackoff = "exponential" // retry_delay doubled after every attempt, capped at retry_max_delay
+	RETRY_BACKOFF_JITTER      RetryBackoff = "jitter"      // a random delay up to the exponential one, so retries of many tasks spread out
+)
+
+// defaults used when a task leaves the retry settings empty
+const (
+	defaultRetryDelay    = time.Second
+	defaultRetryMaxDelay = 5 * time.Minute
+)
+
+// TaskAttempt is one run of the command of a task, a task without retries has a single one.
+type TaskAttempt struct {
+	Attempt         int        `json:"attempt"`
+	Status          TaskStatus `json:"status"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      time.Time  `json:"finished_at"`
+	ExitCode        *int       `json:"exit_code,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	Stdout          string     `json:"stdout"`
+	Stderr          string     `json:"stderr"`
+	StdoutTruncated bool       `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool       `json:"stderr_truncated,omitempty"`
+}
+
+// validateRetry rejects unknown backoff strategies and negative retry settings.
+func validateRetry(spec TaskSpec) error {
+	switch spec.RetryBackoff {
+	case "", RETRY_BACKOFF_FIXED, RETRY_BACKOFF_EXPONENTIAL, RETRY_BACKOFF_JITTER:
+	default:
+		return fmt.Errorf("%w: retry_backoff %q must be one of fixed, exponential or jitter", ErrInvalidTask, spec.RetryBackoff)
+	}
+	if spec.MaxAttempts < 0 || spec.RetryDelay < 0 || spec.RetryMaxDelay < 0 {
+		return fmt.Errorf("%w: retry settings cannot be negative", ErrInvalidTask)
+	}
+	return nil
+}
+
+// shouldRetry tells if a failed attempt may be retried: timeouts and failures are retried unless retry_on
+// lists exit codes, then only those are. A cancelled task is never retried.
+func shouldRetry(spec TaskSpec, result taskResult) bool {
+	if result.status != TASK_STATUS_FAILED && result.status != TASK_STATUS_TIMED_OUT {
+		return false
+	}
+	if len(spec.RetryOn) == 0 {
+		return true
+	}
+	if result.exitCode == nil || result.status == TASK_STATUS_TIMED_OUT {
+		return false
+	}
+	for _, code := range spec.RetryOn {
+		if code == *result.exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay returns how long to wait before the attempt following attempt number done.
+func retryDelay(spec TaskSpec, done int) time.Duration {
+	base, maxDelay := defaultRetryDelay, defaultRetryMaxDelay
+	if spec.RetryDelay > 0 {
+		base = time.Duration(spec.RetryDelay) * time.Second
+	}
+	if spec.RetryMaxDelay > 0 {
+		maxDelay = time.Duration(spec.RetryMaxDelay) * time.Second
+	}
+
+	switch spec.RetryBackoff {
+	case RETRY_BACKOFF_EXPONENTIAL:
+		return backoffDelay(base, maxDelay, done-1)
+	case RETRY_BACKOFF_JITTER:
+		return time.Duration(rand.Int63n(int64(backoffDelay(base, maxDelay, done-1)) + 1))
+	}
+	return base
+}
+
+// recordAttempt appends the outcome of the attempt that just ended to a task, must be called with the store lock held.
+func recordAttempt(task *Task, result taskResult) {
+	task.Attempts = append(task.Attempts, TaskAttempt{
+		Attempt:         len(task.Attempts) + 1,
+		Status:          result.status,
+		StartedAt:       task.StartedAt,
+		FinishedAt:      time.Now(),
+		ExitCode:        result.exitCode,
+		Error:           result.err,
+		Stdout:          result.stdout.String(),
+		Stderr:          result.stderr.String(),
+		StdoutTruncated: result.stdout.truncated,
+		StderrTruncated: result.stderr.truncated,
+	})
+}
+
+// retryTask queues the next attempt of a task that failed, or tells that it has none left.
+// Must be called with the store lock held.
+func retryTask(task *Task, result taskResult) bool {
+	if !shouldRetry(task.TaskSpec, result) {
+		return false
+	}
+	attempts := len(task.Attempts)
+	if attempts >= task.MaxAttempts {
+		task.RetriesExhausted = task.MaxAttempts > 1
+		return false
+	}
+
+	delay := retryDelay(task.TaskSpec, attempts)
+	task.Status = TASK_STATUS_PENDING
+	task.NextAttemptAt = time.Now().Add(delay)
+	heap.Push(&tasks.queue, task)
+	wakeScheduler()
+	log.Printf("Task %d (%s) attempt %d of %d %s, retrying in %s", task.ID, task.Description, attempts, task.MaxAttempts, result.err, delay.Round(time.Millisecond))
+	return true
+}
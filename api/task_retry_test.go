@@ -0,0 +1,121 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func exitResult(status TaskStatus, code int) taskResult {
+	return taskResult{status: status, exitCode: &code, stdout: &cappedBuffer{}, stderr: &cappedBuffer{}}
+}
+
+func TestShouldRetry(t *testing.T) {
+	timedOut := taskResult{status: TASK_STATUS_TIMED_OUT}
+	tests := []struct {
+		name    string
+		retryOn []int
+		result  taskResult
+		want    bool
+	}{
+		{"failure", nil, exitResult(TASK_STATUS_FAILED, 1), true},
+		{"timeout", nil, timedOut, true},
+		{"success", nil, exitResult(TASK_STATUS_SUCCEEDED, 0), false},
+		{"cancelled", nil, exitResult(TASK_STATUS_CANCELLED, -1), false},
+		{"listed code", []int{75, 1}, exitResult(TASK_STATUS_FAILED, 1), true},
+		{"other code", []int{75}, exitResult(TASK_STATUS_FAILED, 1), false},
+		{"timeout with codes", []int{75}, timedOut, false},
+		{"no exit code with codes", []int{75}, taskResult{status: TASK_STATUS_FAILED}, false},
+	}
+	for _, tt := range tests {
+		if got := shouldRetry(TaskSpec{RetryOn: tt.retryOn}, tt.result); got != tt.want {
+			t.Errorf("%s: shouldRetry = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		spec TaskSpec
+		done int
+		want time.Duration
+	}{
+		{TaskSpec{}, 1, time.Second},
+		{TaskSpec{}, 5, time.Second},
+		{TaskSpec{RetryDelay: 3}, 4, 3 * time.Second},
+		{TaskSpec{RetryBackoff: RETRY_BACKOFF_FIXED, RetryDelay: 3}, 4, 3 * time.Second},
+		{TaskSpec{RetryBackoff: RETRY_BACKOFF_EXPONENTIAL, RetryDelay: 2}, 1, 2 * time.Second},
+		{TaskSpec{RetryBackoff: RETRY_BACKOFF_EXPONENTIAL, RetryDelay: 2}, 2, 4 * time.Second},
+		{TaskSpec{RetryBackoff: RETRY_BACKOFF_EXPONENTIAL, RetryDelay: 2}, 4, 16 * time.Second},
+		{TaskSpec{RetryBackoff: RETRY_BACKOFF_EXPONENTIAL, RetryDelay: 2, RetryMaxDelay: 10}, 4, 10 * time.Second},
+		{TaskSpec{RetryBackoff: RETRY_BACKOFF_EXPONENTIAL}, 20, defaultRetryMaxDelay},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.spec, tt.done); got != tt.want {
+			t.Errorf("retryDelay(%+v, %d) = %s, want %s", tt.spec, tt.done, got, tt.want)
+		}
+	}
+
+	// jitter stays between zero and the exponential delay
+	spec := TaskSpec{RetryBackoff: RETRY_BACKOFF_JITTER, RetryDelay: 2, RetryMaxDelay: 10}
+	for done := 1; done <= 5; done++ {
+		limit := retryDelay(TaskSpec{RetryBackoff: RETRY_BACKOFF_EXPONENTIAL, RetryDelay: 2, RetryMaxDelay: 10}, done)
+		for i := 0; i < 100; i++ {
+			if got := retryDelay(spec, done); got < 0 || got > limit {
+				t.Fatalf("jitter delay after %d attempts = %s, want between 0 and %s", done, got, limit)
+			}
+		}
+	}
+}
+
+func TestRetryTask(t *testing.T) {
+	useTestTaskStore(t, 1)
+
+	tests := []struct {
+		name      string
+		spec      TaskSpec
+		attempts  int
+		result    taskResult
+		retried   bool
+		exhausted bool
+		delay     time.Duration
+	}{
+		{"single attempt", TaskSpec{}, 1, exitResult(TASK_STATUS_FAILED, 1), false, false, 0},
+		{"max_attempts 1", TaskSpec{MaxAttempts: 1}, 1, exitResult(TASK_STATUS_FAILED, 1), false, false, 0},
+		{"first retry", TaskSpec{MaxAttempts: 3, RetryDelay: 2}, 1, exitResult(TASK_STATUS_FAILED, 1), true, false, 2 * time.Second},
+		{"last retry", TaskSpec{MaxAttempts: 3, RetryDelay: 2, RetryBackoff: RETRY_BACKOFF_EXPONENTIAL}, 2,
+			exitResult(TASK_STATUS_FAILED, 1), true, false, 4 * time.Second},
+		{"attempts used up", TaskSpec{MaxAttempts: 3}, 3, exitResult(TASK_STATUS_FAILED, 1), false, true, 0},
+		{"timeout retried", TaskSpec{MaxAttempts: 2}, 1, taskResult{status: TASK_STATUS_TIMED_OUT}, true, false, time.Second},
+		{"code not listed", TaskSpec{MaxAttempts: 3, RetryOn: []int{75}}, 1, exitResult(TASK_STATUS_FAILED, 1), false, false, 0},
+		{"listed code", TaskSpec{MaxAttempts: 3, RetryOn: []int{75}}, 1, exitResult(TASK_STATUS_FAILED, 75), true, false, time.Second},
+		{"success", TaskSpec{MaxAttempts: 3}, 1, exitResult(TASK_STATUS_SUCCEEDED, 0), false, false, 0},
+	}
+
+	tasks.Lock()
+	defer tasks.Unlock()
+	for _, tt := range tests {
+		task := &Task{TaskSpec: tt.spec, ID: nextTaskID(), Status: TASK_STATUS_RUNNING, Attempts: make([]TaskAttempt, tt.attempts), queueIndex: -1, readyIndex: -1}
+		tasks.tasks[task.ID] = task
+
+		before := time.Now()
+		if got := retryTask(task, tt.result); got != tt.retried {
+			t.Errorf("%s: retried = %v, want %v", tt.name, got, tt.retried)
+			continue
+		}
+		if task.RetriesExhausted != tt.exhausted {
+			t.Errorf("%s: retries exhausted = %v, want %v", tt.name, task.RetriesExhausted, tt.exhausted)
+		}
+		if !tt.retried {
+			if task.queueIndex >= 0 || task.Status != TASK_STATUS_RUNNING {
+				t.Errorf("%s: a task without a retry is %s at queue index %d", tt.name, task.Status, task.queueIndex)
+			}
+			continue
+		}
+		if task.Status != TASK_STATUS_PENDING || task.queueIndex < 0 {
+			t.Errorf("%s: retried task is %s at queue index %d, want it pending in the queue", tt.name, task.Status, task.queueIndex)
+		}
+		if wait := task.NextAttemptAt.Sub(before); wait < tt.delay || wait > tt.delay+time.Second {
+			t.Errorf("%s: next attempt in %s, want %s", tt.name, wait, tt.delay)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// bytes of stdout and of stderr kept for every task, the rest is dropped
+const taskOutputLimit = 64 * 1024
+
+// how long a killed task may keep its output pipes open through leftover children
+const taskWaitDelay = 5 * time.Second
+
+// cappedBuffer keeps the first limit bytes written to it and remembers whether anything was dropped.
+// The buffer is not embedded, its ReadFrom would let io.Copy go around the cap.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Write never fails so the command is not killed by a broken pipe once the cap is reached.
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
+
+// taskResult is the outcome of one run of a task command.
+type taskResult struct {
+	status   TaskStatus
+	exitCode *int
+	err      string
+	stdout   *cappedBuffer
+	stderr   *cappedBuffer
+}
+
+// validateTaskSpec checks that a task has something to run before it is accepted.
+func validateTaskSpec(spec TaskSpec) error {
+	set := 0
+	for _, ok := range []bool{len(spec.Command) > 0, spec.Shell != "", spec.Action != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set == 0 {
+		return fmt.Errorf("%w: one of command, shell or action must be set", ErrInvalidTask)
+	}
+	if set > 1 {
+		return fmt.Errorf("%w: only one of command, shell and action can be set", ErrInvalidTask)
+	}
+	if spec.Action != nil {
+		if err := validateTaskAction(spec.Action); err != nil {
+			return err
+		}
+	}
+	if len(spec.Command) > 0 {
+		if _, err := exec.LookPath(spec.Command[0]); err != nil {
+			return fmt.Errorf("%w: command %q cannot be found: %v", ErrInvalidTask, spec.Command[0], err)
+		}
+	}
+	for _, kv := range spec.Env {
+		if !strings.Contains(kv, "=") {
+			return fmt.Errorf("%w: env entry %q must be KEY=VALUE", ErrInvalidTask, kv)
+		}
+	}
+	if spec.WorkingDir != "" {
+		info, err := os.Stat(spec.WorkingDir)
+		if err != nil {
+			return fmt.Errorf("%w: working dir: %v", ErrInvalidTask, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%w: working dir %s is not a directory", ErrInvalidTask, spec.WorkingDir)
+		}
+	}
+	if spec.Timeout < 0 {
+		return fmt.Errorf("%w: timeout cannot be negative", ErrInvalidTask)
+	}
+	if err := validateRetry(spec); err != nil {
+		return err
+	}
+	return validateMissedRun(spec.MissedRun)
+}
+
+// buildTaskCommand turns a task spec into a command running in its own process group, so a timeout kills its children too.
+func buildTaskCommand(ctx context.Context, spec TaskSpec) *exec.Cmd {
+	var cmd *exec.Cmd
+	if spec.Shell != "" {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", spec.Shell)
+	} else {
+		cmd = exec.CommandContext(ctx, spec.Command[0], spec.Command[1:]...)
+	}
+	cmd.Dir = spec.WorkingDir
+	cmd.Env = append(os.Environ(), spec.Env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = taskWaitDelay
+	return cmd
+}
+
+// runTaskCommand runs the command of a task to completion and captures its output. Cancelling ctx and
+// reaching the timeout both kill the process group of the command. The kept output is also recorded in out.
+func runTaskCommand(ctx context.Context, spec TaskSpec, out *taskOutput) taskResult {
+	result := taskResult{
+		stdout: &cappedBuffer{limit: taskOutputLimit},
+		stderr: &cappedBuffer{limit: taskOutputLimit},
+	}
+
+	if spec.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(spec.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	cmd := buildTaskCommand(ctx, spec)
+	cmd.Stdout = &taskStreamWriter{buf: result.stdout, out: out, stream: LOG_STREAM_STDOUT}
+	cmd.Stderr = &taskStreamWriter{buf: result.stderr, out: out, stream: LOG_STREAM_STDERR}
+
+	err := cmd.Run()
+	if cmd.ProcessState != nil {
+		code := exitCodeOf(cmd, err)
+		result.exitCode = &code
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result.status = TASK_STATUS_TIMED_OUT
+		result.err = fmt.Sprintf("timed out after %ds", spec.Timeout)
+	case errors.Is(ctx.Err(), context.Canceled):
+		result.status = TASK_STATUS_CANCELLED
+		result.err = "cancelled while running"
+	case cmd.ProcessState == nil:
+		result.status = TASK_STATUS_FAILED
+		result.err = err.Error()
+	case *result.exitCode != 0:
+		result.status = TASK_STATUS_FAILED
+		result.err = exitReasonOf(cmd, *result.exitCode)
+	default:
+		result.status = TASK_STATUS_SUCCEEDED
+	}
+	return result
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// MissedRunPolicy decides what happens to a task whose run time passed while the panel was not running.
+type MissedRunPolicy string
+
+const (
+	MISSED_RUN_RUN  MissedRunPolicy = "run"  // run it as soon as possible
+	MISSED_RUN_SKIP MissedRunPolicy = "skip" // cancel it without running
+)
+
+// DefaultMissedRunPolicy applies to tasks that do not set missed_run.
+var DefaultMissedRunPolicy = MISSED_RUN_RUN
+
+// MissedRunGrace is how late a task may be started before its run counts as missed.
+var MissedRunGrace = time.Minute
+
+// TaskStateFile keeps the next ids, the tasks that have not finished and the workflows across panel restarts,
+// finished tasks go to TaskHistoryDir.
+var TaskStateFile = filepath.Join("data", "tasks.json")
+
+// taskState is the content of the task state file, tasks that were waiting for a worker are saved as scheduled.
+type taskState struct {
+	NextID         int            `json:"next_id"`
+	Scheduled      []*Task        `json:"scheduled"`
+	Running        []*Task        `json:"running,omitempty"`
+	Waiting        []*Task        `json:"waiting,omitempty"` // runs held back by the queue overlap policy, in order
+	MaxConcurrency int            `json:"max_concurrency,omitempty"`
+	QueueLimits    map[string]int `json:"queue_limits,omitempty"`
+
+	NextWorkflowID int         `json:"next_workflow_id,omitempty"`
+	Workflows      []*Workflow `json:"workflows,omitempty"`
+}
+
+// taskQueue is a heap of the pending tasks ordered by run time, the earliest first.
+type taskQueue []*Task
+
+func (q taskQueue) Len() int { return len(q) }
+
+func (q taskQueue) Less(i, j int) bool {
+	if q[i].dueAt().Equal(q[j].dueAt()) {
+		return q[i].ID < q[j].ID
+	}
+	return q[i].dueAt().Before(q[j].dueAt())
+}
+
+func (q taskQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].queueIndex = i
+	q[j].queueIndex = j
+}
+
+func (q *taskQueue) Push(x interface{}) {
+	task := x.(*Task)
+	task.queueIndex = len(*q)
+	*q = append(*q, task)
+}
+
+func (q *taskQueue) Pop() interface{} {
+	old := *q
+	task := old[len(old)-1]
+	old[len(old)-1] = nil
+	task.queueIndex = -1
+	*q = old[:len(old)-1]
+	return task
+}
+
+// dueAt is when a queued task should start: its run time, or the time of its next attempt after a failure.
+func (t *Task) dueAt() time.Time {
+	if !t.NextAttemptAt.IsZero() {
+		return t.NextAttemptAt
+	}
+	return t.RunTime
+}
+
+// validateMissedRun rejects unknown policies, an empty one means the default.
+func validateMissedRun(policy MissedRunPolicy) error {
+	switch policy {
+	case "", MISSED_RUN_RUN, MISSED_RUN_SKIP:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown missed_run policy %q", ErrInvalidTask, policy)
+}
+
+// wakeScheduler tells the scheduler that the head of the queue may have changed.
+func wakeScheduler() {
+	select {
+	case tasks.wake <- struct{}{}:
+	default:
+	}
+}
+
+// scheduleTask queues a pending task for its run time, or starts it when that time has come.
+// Must be called with the store lock held.
+func scheduleTask(task *Task) {
+	if !task.RunTime.After(time.Now()) {
+		enqueueTask(task)
+		return
+	}
+	heap.Push(&tasks.queue, task)
+	wakeScheduler()
+}
+
+// launchTask moves a task that got a worker to RUNNING and executes it in the background,
+// must be called with the store lock held.
+func launchTask(task *Task) {
+	ctx, cancel := context.WithCancel(context.Background())
+	task.Status = TASK_STATUS_RUNNING
+	task.StartedAt = time.Now()
+	task.NextAttemptAt = time.Time{}
+	task.cancel = cancel
+	if task.output == nil {
+		task.output = newTaskOutput()
+	}
+	task.output.startAttempt(len(task.Attempts) + 1)
+	go executeTask(ctx, task, task.TaskSpec, task.output)
+}
+
+// dispatchTask starts a task taken off the queue, unless its run was missed and its policy says to skip it
+// or it is a recurring run held back by its overlap policy. Must be called with the store lock held.
+func dispatchTask(task *Task, now time.Time) {
+	if task.RecurringTask != "" && len(task.Attempts) == 0 {
+		continueRecurring(task, now)
+	}
+
+	late := now.Sub(task.dueAt())
+	if late <= MissedRunGrace {
+		admitTask(task)
+		return
+	}
+
+	policy := task.MissedRun
+	if policy == "" {
+		policy = DefaultMissedRunPolicy
+	}
+	if policy == MISSED_RUN_SKIP {
+		cancelTask(task, fmt.Sprintf("run time %s was missed by %s, skipped by the missed run policy", task.dueAt().Format(time.RFC3339), late.Round(time.Second)))
+		if len(task.Attempts) > 0 {
+			finishRecurringRun(task)
+		}
+		log.Printf("Task %d (%s) skipped, its run was missed", task.ID, task.Description)
+		return
+	}
+	log.Printf("Task %d (%s) starts %s late", task.ID, task.Description, late.Round(time.Second))
+	admitTask(task)
+}
+
+// admitTask starts a due task, runs of a recurring task first go through its overlap policy, retries
+// were admitted with their first attempt. Must be called with the store lock held.
+func admitTask(task *Task) {
+	if task.RecurringTask != "" && len(task.Attempts) == 0 && !admitRecurringRun(task) {
+		return
+	}
+	enqueueTask(task)
+}
+
+// runScheduler starts the queued tasks when their time comes, with a single timer armed for the head of the queue.
+func runScheduler() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		tasks.Lock()
+		now := time.Now()
+		dispatched := false
+		for tasks.queue.Len() > 0 && !tasks.queue[0].dueAt().After(now) {
+			dispatchTask(heap.Pop(&tasks.queue).(*Task), now)
+			dispatched = true
+		}
+		if dispatched {
+			persistTasks()
+		}
+		if tasks.queue.Len() > 0 {
+			timer.Reset(tasks.queue[0].dueAt().Sub(now))
+		}
+		tasks.Unlock()
+
+		select {
+		case <-timer.C:
+		case <-tasks.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// RescheduleTask moves the run time of a task that has not started yet.
+func RescheduleTask(taskID int, runTime time.Time) (Task, error) {
+	tasks.Lock()
+	defer tasks.Unlock()
+
+	task, ok := tasks.tasks[taskID]
+	if !ok {
+		return Task{}, fmt.Errorf("%w: no task with id %d", ErrTaskNotFound, taskID)
+	}
+	if task.queueIndex < 0 {
+		return Task{}, fmt.Errorf("%w: task %d is %s, only queued tasks can be rescheduled", ErrTaskNotPending, taskID, task.Status)
+	}
+
+	if task.NextAttemptAt.IsZero() {
+		task.RunTime = runTime
+	} else {
+		task.NextAttemptAt = runTime
+	}
+	heap.Fix(&tasks.queue, task.queueIndex)
+	persistTasks()
+	wakeScheduler()
+	return task.snapshot(), nil
+}
+
+// persistTasks writes the id counters, the tasks that have not finished and the workflows to the state file,
+// must be called with the store lock held.
+func persistTasks() {
+	state := taskState{
+		NextID:         tasks.nextID,
+		Scheduled:      append(append([]*Task{}, tasks.queue...), tasks.pool.ready...),
+		MaxConcurrency: tasks.pool.maxConcurrency,
+		QueueLimits:    tasks.pool.queueLimits,
+		NextWorkflowID: tasks.nextWorkflowID,
+	}
+	for _, task := range tasks.tasks {
+		if task.Status == TASK_STATUS_RUNNING {
+			state.Running = append(state.Running, task)
+		}
+	}
+	sort.Slice(state.Running, func(i, j int) bool { return state.Running[i].ID < state.Running[j].ID })
+	for _, def := range tasks.recurring {
+		state.Waiting = append(state.Waiting, def.waiting...)
+	}
+	sort.Slice(state.Waiting, func(i, j int) bool { return state.Waiting[i].ID < state.Waiting[j].ID })
+	for _, wf := range tasks.workflows {
+		state.Workflows = append(state.Workflows, wf)
+	}
+	sort.Slice(state.Workflows, func(i, j int) bool { return state.Workflows[i].ID < state.Workflows[j].ID })
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding scheduled tasks: %v", err)
+		return
+	}
+	if err := writeFileAtomic(TaskStateFile, data); err != nil {
+		log.Printf("Error writing scheduled tasks %s: %v", TaskStateFile, err)
+	}
+}
+
+// restoreTasks puts the tasks that were queued when the panel stopped back in the queue, the ones whose time
+// passed meanwhile go through their missed run policy. Tasks that were running end as interrupted and their
+// workflows carry on from there. The recurring runs that were waiting for their previous run are returned for
+// restoreRecurringTasks to hand back to their definitions.
+func restoreTasks() []*Task {
+	data, err := os.ReadFile(TaskStateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error reading scheduled tasks %s: %v", TaskStateFile, err)
+		return nil
+	}
+	var state taskState
+	// the file used to hold only the list of scheduled tasks
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &state.Scheduled)
+	} else {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		log.Printf("Error decoding scheduled tasks %s: %v", TaskStateFile, err)
+		return nil
+	}
+
+	tasks.Lock()
+	defer tasks.Unlock()
+	if state.NextID > tasks.nextID {
+		tasks.nextID = state.NextID
+	}
+	if state.NextWorkflowID > tasks.nextWorkflowID {
+		tasks.nextWorkflowID = state.NextWorkflowID
+	}
+	for _, wf := range state.Workflows {
+		wf.index = make(map[string]int, len(wf.Steps))
+		for i, step := range wf.Steps {
+			wf.index[step.Name] = i
+		}
+		tasks.workflows[wf.ID] = wf
+	}
+	if state.MaxConcurrency > 0 {
+		tasks.pool.maxConcurrency = state.MaxConcurrency
+	}
+	for name, limit := range state.QueueLimits {
+		tasks.pool.queueLimits[name] = limit
+	}
+	for _, task := range state.Scheduled {
+		task.Status = TASK_STATUS_PENDING
+		task.readyIndex = -1
+		tasks.tasks[task.ID] = task
+		heap.Push(&tasks.queue, task)
+		if task.ID >= tasks.nextID {
+			tasks.nextID = task.ID + 1
+		}
+	}
+	for _, task := range state.Waiting {
+		task.Status = TASK_STATUS_PENDING
+		task.queueIndex = -1
+		task.readyIndex = -1
+		tasks.tasks[task.ID] = task
+	}
+	for _, task := range state.Running {
+		interruptTask(task)
+	}
+	for _, wf := range tasks.workflows {
+		resumeWorkflow(wf)
+	}
+	persistTasks()
+	log.Printf("Restored %d scheduled tasks and %d workflows from %s, next task id is %d", len(state.Scheduled), len(state.Workflows), TaskStateFile, tasks.nextID)
+	return state.Waiting
+}
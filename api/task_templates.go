@@ -0,0 +1,379 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TemplateParamType is what values a template parameter accepts.
+type TemplateParamType string
+
+const (
+	PARAM_STRING TemplateParamType = "string" // any text that does not look like an option
+	PARAM_INT    TemplateParamType = "int"    // a whole number, within min and max when they are set
+	PARAM_ENUM   TemplateParamType = "enum"   // one of values
+	PARAM_REGEX  TemplateParamType = "regex"  // text matching pattern as a whole
+)
+
+// ErrTaskTemplateExists is returned when a template name is taken, the HTTP layer maps it to 409 Conflict
+var ErrTaskTemplateExists = errors.New("task template already exists")
+
+// TaskTemplateFile keeps the task templates across panel restarts.
+var TaskTemplateFile = filepath.Join("data", "task_templates.json")
+
+// TemplateParam is one typed parameter of a template, a parameter without a default is required.
+type TemplateParam struct {
+	Name        string            `json:"name"`
+	Type        TemplateParamType `json:"type"`
+	Description string            `json:"description,omitempty"`
+	Default     *string           `json:"default,omitempty"`
+	Values      []string          `json:"values,omitempty"`  // choices of an enum
+	Pattern     string            `json:"pattern,omitempty"` // expression of a regex parameter
+	Min         *int              `json:"min,omitempty"`
+	Max         *int              `json:"max,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// TaskTemplate is a reusable task whose argv holds {{param}} placeholders. The values are substituted into
+// single arguments and never go through a shell, so a template cannot have a shell command.
+type TaskTemplate struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Params      []TemplateParam `json:"params,omitempty"`
+	Task        TaskSpec        `json:"task"`
+	CreatedTime time.Time       `json:"created_time"`
+}
+
+// placeholderPattern finds the {{param}} placeholders of a template
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// taskTemplates holds the templates by name, they are independent of the task store lock
+var taskTemplates = struct {
+	sync.RWMutex
+	templates map[string]*TaskTemplate
+}{templates: make(map[string]*TaskTemplate)}
+
+// validateTemplateParam checks the type settings of a parameter and compiles its pattern.
+func validateTemplateParam(param *TemplateParam) error {
+	switch param.Type {
+	case PARAM_STRING, PARAM_INT:
+	case PARAM_ENUM:
+		if len(param.Values) == 0 {
+			return fmt.Errorf("enum parameter %s has no values", param.Name)
+		}
+	case PARAM_REGEX:
+		// the value has to match as a whole, not just contain a match
+		pattern, err := regexp.Compile(`^(?:` + param.Pattern + `)$`)
+		if err != nil || param.Pattern == "" {
+			return fmt.Errorf("regex parameter %s needs a valid pattern", param.Name)
+		}
+		param.pattern = pattern
+	default:
+		return fmt.Errorf("parameter %s has unknown type %q, expected string, int, enum or regex", param.Name, param.Type)
+	}
+	if (param.Min != nil || param.Max != nil) && param.Type != PARAM_INT {
+		return fmt.Errorf("min and max only apply to int parameters, not to %s", param.Name)
+	}
+	if param.Default != nil {
+		if _, err := param.check(*param.Default); err != nil {
+			return fmt.Errorf("default of parameter %s: %v", param.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateTaskTemplate checks a template and that every placeholder of its argv is a declared parameter.
+func validateTaskTemplate(tmpl *TaskTemplate) error {
+	if tmpl.Name == "" {
+		return fmt.Errorf("%w: template name cannot be empty", ErrInvalidTask)
+	}
+	if tmpl.Task.Shell != "" || tmpl.Task.Action != nil {
+		return fmt.Errorf("%w: a template runs an argv in command, shell and action are not allowed", ErrInvalidTask)
+	}
+	if tmpl.Task.Template != "" || len(tmpl.Task.Params) > 0 {
+		return fmt.Errorf("%w: a template cannot be based on another template", ErrInvalidTask)
+	}
+	if len(tmpl.Task.Command) == 0 {
+		return fmt.Errorf("%w: a template needs a command", ErrInvalidTask)
+	}
+	if placeholderPattern.MatchString(tmpl.Task.Command[0]) {
+		return fmt.Errorf("%w: the program of a template cannot be a parameter", ErrInvalidTask)
+	}
+
+	declared := make(map[string]bool)
+	for i := range tmpl.Params {
+		param := &tmpl.Params[i]
+		if !placeholderPattern.MatchString("{{" + param.Name + "}}") {
+			return fmt.Errorf("%w: invalid parameter name %q", ErrInvalidTask, param.Name)
+		}
+		if declared[param.Name] {
+			return fmt.Errorf("%w: parameter %s is declared twice", ErrInvalidTask, param.Name)
+		}
+		declared[param.Name] = true
+		if err := validateTemplateParam(param); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidTask, err)
+		}
+	}
+	for _, text := range append([]string{tmpl.Task.Description}, tmpl.Task.Command...) {
+		for _, match := range placeholderPattern.FindAllStringSubmatch(text, -1) {
+			if !declared[match[1]] {
+				return fmt.Errorf("%w: placeholder {{%s}} is not a declared parameter", ErrInvalidTask, match[1])
+			}
+		}
+	}
+	return validateTaskSpec(tmpl.Task)
+}
+
+// check validates a value against the type of the parameter and returns its text for the argv.
+func (p *TemplateParam) check(value string) (string, error) {
+	switch p.Type {
+	case PARAM_INT:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a whole number", value)
+		}
+		if p.Min != nil && n < *p.Min || p.Max != nil && n > *p.Max {
+			return "", fmt.Errorf("%d is out of range", n)
+		}
+		// a negative number reads as an option, the template has to allow it with min
+		if n < 0 && p.Min == nil {
+			return "", fmt.Errorf("%d is negative, the parameter has no min allowing it", n)
+		}
+		return strconv.Itoa(n), nil
+	case PARAM_ENUM:
+		for _, allowed := range p.Values {
+			if value == allowed {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("%q is not one of %s", value, strings.Join(p.Values, ", "))
+	case PARAM_REGEX:
+		if !p.pattern.MatchString(value) {
+			return "", fmt.Errorf("%q does not match %s", value, p.Pattern)
+		}
+		return value, nil
+	}
+	// a free text value must not turn into an option of the command
+	if strings.HasPrefix(value, "-") {
+		return "", fmt.Errorf("%q cannot start with -", value)
+	}
+	if strings.ContainsRune(value, 0) {
+		return "", errors.New("value cannot contain a NUL byte")
+	}
+	return value, nil
+}
+
+// paramText turns a JSON parameter value into text, only scalars are accepted.
+func paramText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// render fills in the placeholders of the template with checked values. Every argument stays one argument
+// whatever the values hold.
+func (tmpl *TaskTemplate) render(params map[string]interface{}) (TaskSpec, error) {
+	values := make(map[string]string, len(tmpl.Params))
+	for i := range tmpl.Params {
+		param := &tmpl.Params[i]
+		raw, ok := params[param.Name]
+		if !ok {
+			if param.Default == nil {
+				return TaskSpec{}, fmt.Errorf("%w: parameter %s of template %s is required", ErrInvalidTask, param.Name, tmpl.Name)
+			}
+			values[param.Name] = *param.Default
+			continue
+		}
+		text, ok := paramText(raw)
+		if !ok {
+			return TaskSpec{}, fmt.Errorf("%w: parameter %s must be a string, a number or a boolean", ErrInvalidTask, param.Name)
+		}
+		checked, err := param.check(text)
+		if err != nil {
+			return TaskSpec{}, fmt.Errorf("%w: parameter %s: %v", ErrInvalidTask, param.Name, err)
+		}
+		values[param.Name] = checked
+	}
+	for name := range params {
+		if _, ok := values[name]; !ok {
+			return TaskSpec{}, fmt.Errorf("%w: template %s has no parameter %s", ErrInvalidTask, tmpl.Name, name)
+		}
+	}
+
+	fill := func(text string) string {
+		return placeholderPattern.ReplaceAllStringFunc(text, func(match string) string {
+			return values[placeholderPattern.FindStringSubmatch(match)[1]]
+		})
+	}
+	spec := tmpl.Task
+	spec.Description = fill(spec.Description)
+	spec.Command = make([]string, len(tmpl.Task.Command))
+	for i, arg := range tmpl.Task.Command {
+		spec.Command[i] = fill(arg)
+	}
+	return spec, nil
+}
+
+// expandTaskTemplate renders the template a spec names with its params. The scheduling settings of the spec
+// (description, run time, missed run, queue and priority) take over the ones of the template, what runs
+// comes from the template only. A spec without a template is returned as is.
+func expandTaskTemplate(spec TaskSpec) (TaskSpec, error) {
+	if spec.Template == "" {
+		if len(spec.Params) > 0 {
+			return spec, fmt.Errorf("%w: params are only used with a template", ErrInvalidTask)
+		}
+		return spec, nil
+	}
+	if len(spec.Command) > 0 || spec.Shell != "" || spec.Action != nil {
+		return spec, fmt.Errorf("%w: a task from a template cannot set command, shell or action", ErrInvalidTask)
+	}
+
+	taskTemplates.RLock()
+	tmpl, ok := taskTemplates.templates[spec.Template]
+	taskTemplates.RUnlock()
+	if !ok {
+		return spec, fmt.Errorf("%w: unknown template %s", ErrInvalidTask, spec.Template)
+	}
+	rendered, err := tmpl.render(spec.Params)
+	if err != nil {
+		return spec, err
+	}
+
+	if spec.Description != "" {
+		rendered.Description = spec.Description
+	}
+	if rendered.Description == "" {
+		rendered.Description = tmpl.Name
+	}
+	rendered.RunTime = spec.RunTime
+	if spec.MissedRun != "" {
+		rendered.MissedRun = spec.MissedRun
+	}
+	if spec.Queue != "" {
+		rendered.Queue = spec.Queue
+	}
+	if spec.Priority != 0 {
+		rendered.Priority = spec.Priority
+	}
+	// the task remembers where its command came from
+	rendered.Template, rendered.Params = spec.Template, spec.Params
+	return rendered, nil
+}
+
+// CreateTaskTemplate registers a template.
+func CreateTaskTemplate(tmpl TaskTemplate) (TaskTemplate, error) {
+	if err := validateTaskTemplate(&tmpl); err != nil {
+		return TaskTemplate{}, err
+	}
+
+	taskTemplates.Lock()
+	defer taskTemplates.Unlock()
+	if _, ok := taskTemplates.templates[tmpl.Name]; ok {
+		return TaskTemplate{}, fmt.Errorf("%w: %s", ErrTaskTemplateExists, tmpl.Name)
+	}
+	tmpl.CreatedTime = time.Now()
+	taskTemplates.templates[tmpl.Name] = &tmpl
+	persistTaskTemplates()
+	return tmpl, nil
+}
+
+// ListTaskTemplates returns every template sorted by name, with what a form needs to ask for its parameters.
+func ListTaskTemplates() []TaskTemplate {
+	taskTemplates.RLock()
+	defer taskTemplates.RUnlock()
+
+	list := make([]TaskTemplate, 0, len(taskTemplates.templates))
+	for _, tmpl := range taskTemplates.templates {
+		list = append(list, *tmpl)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GetTaskTemplate returns one template.
+func GetTaskTemplate(name string) (TaskTemplate, error) {
+	taskTemplates.RLock()
+	defer taskTemplates.RUnlock()
+
+	tmpl, ok := taskTemplates.templates[name]
+	if !ok {
+		return TaskTemplate{}, fmt.Errorf("%w: no task template %s", ErrTaskNotFound, name)
+	}
+	return *tmpl, nil
+}
+
+// DeleteTaskTemplate removes a template, tasks already created from it keep their rendered command.
+func DeleteTaskTemplate(name string) error {
+	taskTemplates.Lock()
+	defer taskTemplates.Unlock()
+
+	if _, ok := taskTemplates.templates[name]; !ok {
+		return fmt.Errorf("%w: no task template %s", ErrTaskNotFound, name)
+	}
+	delete(taskTemplates.templates, name)
+	persistTaskTemplates()
+	return nil
+}
+
+// persistTaskTemplates writes the templates to their state file, must be called with the template lock held.
+func persistTaskTemplates() {
+	list := make([]*TaskTemplate, 0, len(taskTemplates.templates))
+	for _, tmpl := range taskTemplates.templates {
+		list = append(list, tmpl)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding task templates: %v", err)
+		return
+	}
+	if err := writeFileAtomic(TaskTemplateFile, data); err != nil {
+		log.Printf("Error writing task templates %s: %v", TaskTemplateFile, err)
+	}
+}
+
+// restoreTaskTemplates loads the templates saved by the previous run of the panel.
+func restoreTaskTemplates() {
+	data, err := os.ReadFile(TaskTemplateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading task templates %s: %v", TaskTemplateFile, err)
+		return
+	}
+	var list []*TaskTemplate
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Error decoding task templates %s: %v", TaskTemplateFile, err)
+		return
+	}
+
+	taskTemplates.Lock()
+	defer taskTemplates.Unlock()
+	for _, tmpl := range list {
+		if err := validateTaskTemplate(tmpl); err != nil {
+			log.Printf("Error restoring task template %s: %v", tmpl.Name, err)
+			continue
+		}
+		taskTemplates.templates[tmpl.Name] = tmpl
+	}
+	log.Printf("Restored %d task templates from %s", len(taskTemplates.templates), TaskTemplateFile)
+}
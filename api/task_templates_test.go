@@ -0,0 +1,176 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestTemplate validates a template the way CreateTaskTemplate does, so its patterns are compiled.
+func newTestTemplate(t *testing.T, tmpl TaskTemplate) *TaskTemplate {
+	t.Helper()
+	if err := validateTaskTemplate(&tmpl); err != nil {
+		t.Fatalf("validateTaskTemplate(%s): %v", tmpl.Name, err)
+	}
+	return &tmpl
+}
+
+func intPtr(n int) *int { return &n }
+
+func strPtr(s string) *string { return &s }
+
+func TestTaskTemplateValuesStayArguments(t *testing.T) {
+	tmpl := newTestTemplate(t, TaskTemplate{
+		Name: "greet",
+		Params: []TemplateParam{
+			{Name: "msg", Type: PARAM_STRING},
+			{Name: "user", Type: PARAM_REGEX, Pattern: "[a-z]+"},
+			{Name: "count", Type: PARAM_INT, Default: strPtr("1")},
+		},
+		Task: TaskSpec{Command: []string{"/bin/echo", "{{msg}}", "--user={{user}}", "{{count}}"}},
+	})
+
+	tests := []struct {
+		msg  string
+		want []string
+	}{
+		{"hello world", []string{"/bin/echo", "hello world", "--user=bob", "1"}},
+		{"a; rm -rf /", []string{"/bin/echo", "a; rm -rf /", "--user=bob", "1"}},
+		{"$(id) `id` ${HOME}", []string{"/bin/echo", "$(id) `id` ${HOME}", "--user=bob", "1"}},
+		{"line\n--force", []string{"/bin/echo", "line\n--force", "--user=bob", "1"}},
+		{"'quoted' \"twice\"", []string{"/bin/echo", "'quoted' \"twice\"", "--user=bob", "1"}},
+		{"*", []string{"/bin/echo", "*", "--user=bob", "1"}},
+		{"{{user}}", []string{"/bin/echo", "{{user}}", "--user=bob", "1"}},
+	}
+	for _, tt := range tests {
+		spec, err := tmpl.render(map[string]interface{}{"msg": tt.msg, "user": "bob"})
+		if err != nil {
+			t.Errorf("%q: %v", tt.msg, err)
+			continue
+		}
+		if !reflect.DeepEqual(spec.Command, tt.want) {
+			t.Errorf("%q: command = %q, want %q", tt.msg, spec.Command, tt.want)
+		}
+	}
+}
+
+func TestTaskTemplateValuesCannotBeOptions(t *testing.T) {
+	tmpl := newTestTemplate(t, TaskTemplate{
+		Name: "opts",
+		Params: []TemplateParam{
+			{Name: "text", Type: PARAM_STRING, Default: strPtr("x")},
+			{Name: "n", Type: PARAM_INT, Default: strPtr("1")},
+			{Name: "offset", Type: PARAM_INT, Min: intPtr(-10), Default: strPtr("0")},
+			{Name: "name", Type: PARAM_REGEX, Pattern: "[a-z]+", Default: strPtr("a")},
+		},
+		Task: TaskSpec{Command: []string{"/bin/echo", "{{text}}", "{{n}}", "{{offset}}", "{{name}}"}},
+	})
+
+	tests := []struct {
+		params  map[string]interface{}
+		wantErr string
+	}{
+		{map[string]interface{}{"text": "-rf"}, "cannot start with -"},
+		{map[string]interface{}{"text": "--help"}, "cannot start with -"},
+		{map[string]interface{}{"text": "-"}, "cannot start with -"},
+		{map[string]interface{}{"text": "a\x00b"}, "NUL byte"},
+		{map[string]interface{}{"n": "-5"}, "is negative"},
+		{map[string]interface{}{"n": -5.0}, "is negative"},
+		{map[string]interface{}{"offset": "-11"}, "out of range"},
+		{map[string]interface{}{"name": "-a"}, "does not match"},
+		{map[string]interface{}{"name": "abc --force"}, "does not match"},
+		{map[string]interface{}{"name": "abc\n"}, "does not match"},
+		// values allowed by their type
+		{map[string]interface{}{"text": "a-b"}, ""},
+		{map[string]interface{}{"offset": "-10"}, ""},
+		{map[string]interface{}{"n": "+5"}, ""},
+	}
+	for _, tt := range tests {
+		spec, err := tmpl.render(tt.params)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%v: unexpected error %v", tt.params, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%v = %v, want an error containing %q", tt.params, err, tt.wantErr)
+		case err == nil && len(spec.Command) != 5:
+			t.Errorf("%v: command %q has %d arguments, want 5", tt.params, spec.Command, len(spec.Command))
+		}
+	}
+}
+
+func TestTaskTemplateParamChecks(t *testing.T) {
+	tmpl := newTestTemplate(t, TaskTemplate{
+		Name: "backup",
+		Params: []TemplateParam{
+			{Name: "path", Type: PARAM_STRING},
+			{Name: "level", Type: PARAM_INT, Min: intPtr(1), Max: intPtr(9), Default: strPtr("6")},
+			{Name: "mode", Type: PARAM_ENUM, Values: []string{"full", "incremental"}, Default: strPtr("full")},
+		},
+		Task: TaskSpec{Command: []string{"/bin/echo", "{{path}}", "-{{level}}", "--mode", "{{mode}}"}},
+	})
+
+	tests := []struct {
+		name    string
+		params  map[string]interface{}
+		want    []string
+		wantErr string
+	}{
+		{"defaults", map[string]interface{}{"path": "/etc"}, []string{"/bin/echo", "/etc", "-6", "--mode", "full"}, ""},
+		{"all set", map[string]interface{}{"path": "/var", "level": 9.0, "mode": "incremental"},
+			[]string{"/bin/echo", "/var", "-9", "--mode", "incremental"}, ""},
+		{"int as text", map[string]interface{}{"path": "/var", "level": "03"}, []string{"/bin/echo", "/var", "-3", "--mode", "full"}, ""},
+		{"number for a string", map[string]interface{}{"path": 42.0}, []string{"/bin/echo", "42", "-6", "--mode", "full"}, ""},
+		{"required missing", map[string]interface{}{}, nil, "parameter path of template backup is required"},
+		{"unknown parameter", map[string]interface{}{"path": "/etc", "force": true}, nil, "has no parameter force"},
+		{"not a scalar", map[string]interface{}{"path": []interface{}{"/etc"}}, nil, "must be a string, a number or a boolean"},
+		{"null", map[string]interface{}{"path": nil}, nil, "must be a string, a number or a boolean"},
+		{"below min", map[string]interface{}{"path": "/etc", "level": 0.0}, nil, "0 is out of range"},
+		{"above max", map[string]interface{}{"path": "/etc", "level": "10"}, nil, "10 is out of range"},
+		{"not a whole number", map[string]interface{}{"path": "/etc", "level": 1.5}, nil, "is not a whole number"},
+		{"not a number", map[string]interface{}{"path": "/etc", "level": "five"}, nil, "is not a whole number"},
+		{"enum", map[string]interface{}{"path": "/etc", "mode": "Full"}, nil, "is not one of full, incremental"},
+	}
+	for _, tt := range tests {
+		spec, err := tmpl.render(tt.params)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		case err == nil && !reflect.DeepEqual(spec.Command, tt.want):
+			t.Errorf("%s: command = %q, want %q", tt.name, spec.Command, tt.want)
+		}
+	}
+}
+
+func TestValidateTaskTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    TaskTemplate
+		wantErr string
+	}{
+		{"shell", TaskTemplate{Name: "t", Task: TaskSpec{Shell: "echo {{a}}"}}, "shell and action are not allowed"},
+		{"program", TaskTemplate{Name: "t", Params: []TemplateParam{{Name: "p", Type: PARAM_STRING}},
+			Task: TaskSpec{Command: []string{"{{p}}"}}}, "program of a template cannot be a parameter"},
+		{"undeclared", TaskTemplate{Name: "t", Task: TaskSpec{Command: []string{"/bin/echo", "{{p}}"}}}, "{{p}} is not a declared parameter"},
+		{"twice", TaskTemplate{Name: "t", Params: []TemplateParam{{Name: "p", Type: PARAM_STRING}, {Name: "p", Type: PARAM_INT}},
+			Task: TaskSpec{Command: []string{"/bin/echo"}}}, "declared twice"},
+		{"type", TaskTemplate{Name: "t", Params: []TemplateParam{{Name: "p", Type: "float"}},
+			Task: TaskSpec{Command: []string{"/bin/echo"}}}, "unknown type"},
+		{"bad default", TaskTemplate{Name: "t", Params: []TemplateParam{{Name: "p", Type: PARAM_INT, Max: intPtr(3), Default: strPtr("4")}},
+			Task: TaskSpec{Command: []string{"/bin/echo"}}}, "default of parameter p"},
+		{"min on a string", TaskTemplate{Name: "t", Params: []TemplateParam{{Name: "p", Type: PARAM_STRING, Min: intPtr(1)}},
+			Task: TaskSpec{Command: []string{"/bin/echo"}}}, "only apply to int"},
+		{"enum without values", TaskTemplate{Name: "t", Params: []TemplateParam{{Name: "p", Type: PARAM_ENUM}},
+			Task: TaskSpec{Command: []string{"/bin/echo"}}}, "has no values"},
+		{"regex without pattern", TaskTemplate{Name: "t", Params: []TemplateParam{{Name: "p", Type: PARAM_REGEX}},
+			Task: TaskSpec{Command: []string{"/bin/echo"}}}, "needs a valid pattern"},
+	}
+	for _, tt := range tests {
+		tmpl := tt.tmpl
+		err := validateTaskTemplate(&tmpl)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -1,36 +1,156 @@
 package api
 
 import (
+	"container/heap"
+	"context"
 	"errors"
 	"fmt"
-	"math/rand"
+	"log"
 	"sync"
 	"time"
 )
 
+// TaskStatus is where a task is in its life.
+type TaskStatus string
+
+const (
+	TASK_STATUS_PENDING   TaskStatus = "PENDING"
+	TASK_STATUS_RUNNING   TaskStatus = "RUNNING"
+	TASK_STATUS_SUCCEEDED TaskStatus = "SUCCEEDED"
+	TASK_STATUS_FAILED    TaskStatus = "FAILED"
+	TASK_STATUS_TIMED_OUT TaskStatus = "TIMED_OUT"
+	TASK_STATUS_CANCELLED TaskStatus = "CANCELLED"
+)
+
+// errors the HTTP layer maps to 400 Bad Request, 404 Not Found and 409 Conflict
+var (
+	ErrInvalidTask     = errors.New("invalid task")
+	ErrTaskNotFound    = errors.New("task not found")
+	ErrTaskNotPending  = errors.New("task is not pending")
+	ErrTaskFinished    = errors.New("task already finished")
+	ErrTaskNotFinished = errors.New("task has not finished")
+)
+
+// TaskSpec is what a task runs: an argv in Command, a string for /bin/sh -c in Shell or a panel operation in Action.
+type TaskSpec struct {
+	Description string      `json:"description"`
+	RunTime     time.Time   `json:"run_time"` // for specific scheduling operation
+	Command     []string    `json:"command,omitempty"`
+	Shell       string      `json:"shell,omitempty"`
+	Env         []string    `json:"env,omitempty"` // KEY=VALUE pairs added on top of the panel environment
+	WorkingDir  string      `json:"working_dir,omitempty"`
+	Timeout     int         `json:"timeout,omitempty"` // seconds, no limit when zero
+	Action      *TaskAction `json:"action,omitempty"`
+
+	MissedRun MissedRunPolicy `json:"missed_run,omitempty"` // what to do when the panel was down at run time
+	Queue     string          `json:"queue,omitempty"`      // worker pool queue, see ConfigureTaskPool
+	Priority  int             `json:"priority,omitempty"`   // higher runs first among the tasks waiting for a worker
+
+	MaxAttempts   int          `json:"max_attempts,omitempty"`    // runs of the command before giving up, defaults to 1
+	RetryBackoff  RetryBackoff `json:"retry_backoff,omitempty"`   // fixed, exponential or jitter, defaults to fixed
+	RetryDelay    int          `json:"retry_delay,omitempty"`     // seconds before the first retry, defaults to 1
+	RetryMaxDelay int          `json:"retry_max_delay,omitempty"` // upper bound in seconds for the growing backoffs
+	RetryOn       []int        `json:"retry_on,omitempty"`        // exit codes worth a retry, any failure or timeout when empty
+
+	Template string                 `json:"template,omitempty"` // task template the command is rendered from, see CreateTaskTemplate
+	Params   map[string]interface{} `json:"params,omitempty"`   // values of the template parameters
+}
+
 type Task struct { // public data type structure (Pascal cases on initial names)
+	TaskSpec
+
+	ID          int        `json:"id"`
+	CreatedTime time.Time  `json:"created_time"`
+	IsFinished  bool       `json:"is_finished"`
+	Status      TaskStatus `json:"status"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  time.Time  `json:"finished_at"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+	Error       string     `json:"error,omitempty"` // why the command could not run or was stopped
+
+	RecurringTask string `json:"recurring_task,omitempty"` // name of the recurring task this is a run of
+	Workflow      int    `json:"workflow,omitempty"`       // id of the workflow this is a step of
+	WorkflowStep  string `json:"workflow_step,omitempty"`
+
+	QueuedAt      time.Time `json:"queued_at"`                // when it became due and waited for a worker
+	QueuePosition int       `json:"queue_position,omitempty"` // 1 for the next task to get a worker, filled in when read
+	WaitTime      float64   `json:"wait_seconds"`             // time spent waiting for a worker, filled in when read
+
+	Attempts         []TaskAttempt `json:"attempts,omitempty"`
+	NextAttemptAt    time.Time     `json:"next_attempt_at"` // set while a failed task waits for its retry
+	RetriesExhausted bool          `json:"retries_exhausted,omitempty"`
+
+	Stdout          string `json:"stdout"`
+	Stderr          string `json:"stderr"`
+	StdoutTruncated bool   `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool   `json:"stderr_truncated,omitempty"`
+
+	queueIndex int                // position in the scheduler queue, -1 once the task left it
+	readyIndex int                // position among the tasks waiting for a worker, -1 otherwise
+	cancel     context.CancelFunc // stops the command of a running task
+	output     *taskOutput        // live output for the followers until the task finished
+}
 
-	ID          int       `json:"id"`
-	Description string    `json:"description"`
-	CreatedTime time.Time `json:"created_time"`
-	RunTime     time.Time `json:"run_time"` // for specific scheduling operation
-	IsFinished  bool      `json:"is_finished"`
+// snapshot copies a task so it can be handed out while the original keeps changing, must be called with the store lock held.
+func (t *Task) snapshot() Task {
+	copied := *t
+	if t.ExitCode != nil {
+		code := *t.ExitCode
+		copied.ExitCode = &code
+	}
+	copied.Attempts = append([]TaskAttempt(nil), t.Attempts...)
+	switch {
+	case t.readyIndex >= 0:
+		copied.QueuePosition = t.readyIndex + 1
+		copied.WaitTime = time.Since(t.QueuedAt).Seconds()
+	case !t.StartedAt.IsZero() && !t.QueuedAt.IsZero():
+		copied.WaitTime = t.StartedAt.Sub(t.QueuedAt).Seconds()
+	}
+	return copied
 }
 
 // general type to access in all place (Pascal cases on initial names)
 type TaskStore struct { // also type to make type exports and accessible. struct name from `tasks` are declared on public
-	tasks map[int]*Task
+	tasks     map[int]*Task
+	queue     taskQueue     // tasks waiting for their run time
+	wake      chan struct{} // pokes the scheduler when the queue changes
+	recurring map[string]*RecurringTask
+	nextID    int // ids are never reused, the counter is persisted with the scheduled tasks
+	pool      taskPool
+
+	workflows      map[int]*Workflow
+	nextWorkflowID int
 
 	sync.RWMutex
 }
 
 var tasks *TaskStore // and a struct implementation of exported variables .
 
-// initializes an empty list of task struct to keep running information (its a in memory volatile solution) ( export )
+// initializes the task store with the history, the scheduled tasks and the workflows saved by the previous run ( export )
 func InitTasks() {
 	tasks = &TaskStore{
-		tasks: make(map[int]*Task),
+		tasks:     make(map[int]*Task),
+		wake:      make(chan struct{}, 1),
+		recurring: make(map[string]*RecurringTask),
+		workflows: make(map[int]*Workflow),
+		// workflow ids start at 1, 0 is a task outside of any workflow
+		nextWorkflowID: 1,
+		pool: taskPool{
+			maxConcurrency: TaskMaxConcurrency,
+			queueLimits:    make(map[string]int),
+			queueRunning:   make(map[string]int),
+		},
+	}
+	restoreTaskTemplates()
+	restoreTaskHistory()
+	restoreRecurringTasks(restoreTasks())
+	tasks.Lock()
+	if pruned := pruneTaskHistory(time.Now(), true); pruned > 0 {
+		log.Printf("Pruned %d finished tasks from the history", pruned)
 	}
+	tasks.Unlock()
+	go runScheduler()
+	go runTaskHistoryPruner()
 }
 
 // gets the task available on that current struct ( export a method struct )
@@ -42,51 +162,147 @@ func ListTasks() map[int]*Task {
 	copyTasks := make(map[int]*Task)
 
 	for k, v := range tasks.tasks {
-
-		copyTasks[k] = v
+		copied := v.snapshot()
+		copyTasks[k] = &copied
 	}
 	return copyTasks
 
 }
 
 // function for task submission that schedules when it should start to perform specific actions for each taks using a inmemory structure of type task( export  implement also method by Pascal case!)
-func SubmitTask(desc string, runTime time.Time) (Task, error) {
+func SubmitTask(spec TaskSpec) (Task, error) {
+	spec, err := expandTaskTemplate(spec)
+	if err != nil {
+		return Task{}, err
+	}
+	if err := validateTaskSpec(spec); err != nil {
+		return Task{}, err
+	}
 
 	tasks.Lock()
 
 	defer tasks.Unlock()
-	newID := len(tasks.tasks)
+	newID := nextTaskID()
 
 	task := &Task{
+		TaskSpec:    spec,
 		ID:          newID,
-		Description: desc,
 		CreatedTime: time.Now(),
-
-		RunTime:    runTime,
-		IsFinished: false,
+		IsFinished:  false,
+		Status:      TASK_STATUS_PENDING,
+		queueIndex:  -1,
+		readyIndex:  -1,
 	}
 
 	tasks.tasks[newID] = task // all types declared on public level if the used methods , struct data implementation, this avoid to those ""type or variables by compiler". It can now see!.
-	go executeTask(task)      // for  routine also  (pointer struct) implementation if exist in time method
+	scheduleTask(task)        // held back by the scheduler until its run time
+	persistTasks()
 
-	return *task, nil
+	return task.snapshot(), nil
 
 }
 
-// execute simulated task and do changes and return to list that its currently executing task with given parameter for simulating its current state with running for a duration(lower cases since local used no public by types struct at logic ).  Since they does  use that struct but not expose out at `tasks.go`,.
-func executeTask(task *Task) {
-
-	rand.Seed(rand.Int63())
-	sec := rand.Intn(10) + 1
+// nextTaskID hands out the id of a new task, must be called with the store lock held and followed by persistTasks.
+func nextTaskID() int {
+	newID := tasks.nextID
+	tasks.nextID++
+	return newID
+}
 
-	<-time.After(time.Duration(sec) * time.Second)
+// executeTask runs the command of a started task and records how it went.
+func executeTask(ctx context.Context, task *Task, spec TaskSpec, out *taskOutput) {
+	var result taskResult
+	if spec.Action != nil {
+		result = runTaskAction(ctx, task.ID, spec, out)
+	} else {
+		result = runTaskCommand(ctx, spec, out)
+	}
 
 	tasks.Lock()
 	defer tasks.Unlock()
+	task.cancel() // releases the context of a command that ended on its own
+	task.cancel = nil
+	recordAttempt(task, result)
+	task.ExitCode = result.exitCode
+	task.Error = result.err
+	task.Stdout, task.StdoutTruncated = result.stdout.String(), result.stdout.truncated
+	task.Stderr, task.StderrTruncated = result.stderr.String(), result.stderr.truncated
+
+	if retryTask(task, result) {
+		releaseWorker(task)
+		persistTasks()
+		return
+	}
+
+	task.Status = result.status
+	if task.RetriesExhausted {
+		task.Error = fmt.Sprintf("%s, retries exhausted after %d attempts", result.err, len(task.Attempts))
+	}
+	task.FinishedAt = time.Now()
+	task.IsFinished = true
+	saveTaskHistory(task)
+	finishTaskOutput(task)
+	finishRecurringRun(task)
+	releaseWorker(task)
+	advanceWorkflow(task)
+	persistTasks()
+
+	log.Printf("Task %d (%s) finished as %s", task.ID, task.Description, task.Status)
+}
+
+// cancelTask ends a task that never started, must be called with the store lock held.
+func cancelTask(task *Task, reason string) {
+	task.Status = TASK_STATUS_CANCELLED
+	task.Error = reason
+	task.FinishedAt = time.Now()
 	task.IsFinished = true
+	saveTaskHistory(task)
+	finishTaskOutput(task)
+	advanceWorkflow(task)
+}
+
+// CancelTask stops a task: a pending one never starts, the command of a running one is killed with its
+// whole process group and the task ends as CANCELLED once it exited.
+func CancelTask(taskID int) (Task, error) {
+	tasks.Lock()
+	defer tasks.Unlock()
 
-	fmt.Printf("The  taks %d   description was:   %s, with new status now!.\n", task.ID, task.Description)
+	task, ok := tasks.tasks[taskID]
+	if !ok {
+		return Task{}, fmt.Errorf("%w: no task with id %d", ErrTaskNotFound, taskID)
+	}
+	if task.IsFinished {
+		return Task{}, fmt.Errorf("%w: task %d is %s", ErrTaskFinished, taskID, task.Status)
+	}
+	stopTask(task)
+	return task.snapshot(), nil
+}
 
+// stopTask cancels a task that has not finished, must be called with the store lock held.
+func stopTask(task *Task) {
+	if task.cancel != nil {
+		task.cancel()
+		log.Printf("Task %d (%s) cancelled while running", task.ID, task.Description)
+		return
+	}
+
+	if task.queueIndex >= 0 {
+		heap.Remove(&tasks.queue, task.queueIndex)
+		if len(task.Attempts) > 0 {
+			// a retry was admitted with the first attempt
+			finishRecurringRun(task)
+		} else {
+			continueRecurring(task, task.RunTime)
+		}
+		persistTasks()
+		wakeScheduler()
+	}
+	if removeReady(task) {
+		finishRecurringRun(task)
+		persistTasks()
+	}
+	dropWaitingRun(task)
+	cancelTask(task, "cancelled before it started")
 }
 
 // gets specific task information with the specified ID(export types struct with names (must by pascal cases on methods).  )
@@ -99,13 +315,14 @@ func GetTask(taskID int) (Task, error) {
 	task, ok := tasks.tasks[taskID]
 	if ok {
 
-		return *task, nil
+		return task.snapshot(), nil
 	}
-	return Task{}, errors.New(fmt.Sprintf("No tasks was found from list  by id %d. from routes", taskID))
+	return Task{}, fmt.Errorf("%w: no task with id %d", ErrTaskNotFound, taskID)
 
 }
 
 // remove existing task(also a public implemented method with public  by a pascal cases on types). also that implementation do a error handling to validate it!
+// Only finished tasks can be removed, the others have to be cancelled first.
 
 func DeleteTask(taskId int) error {
 
@@ -113,13 +330,16 @@ func DeleteTask(taskId int) error {
 
 	defer tasks.Unlock()
 
-	_, ok := tasks.tasks[taskId]
+	task, ok := tasks.tasks[taskId]
 	if !ok {
 
-		return fmt.Errorf("the tasks :%v is not implemented with this methods.", taskId)
+		return fmt.Errorf("%w: no task with id %d", ErrTaskNotFound, taskId)
+	}
+	if !task.IsFinished {
+		return fmt.Errorf("%w: task %d is %s, cancel it first", ErrTaskNotFinished, taskId, task.Status)
 	}
 
-	delete(tasks.tasks, taskId)
+	removeTaskHistory(taskId)
 
 	return nil
 
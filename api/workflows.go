@@ -0,0 +1,389 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// WorkflowStatus is the aggregate status of the steps of a workflow.
+type WorkflowStatus string
+
+const (
+	WORKFLOW_STATUS_RUNNING   WorkflowStatus = "RUNNING"
+	WORKFLOW_STATUS_SUCCEEDED WorkflowStatus = "SUCCEEDED"
+	WORKFLOW_STATUS_FAILED    WorkflowStatus = "FAILED" // at least one step failed or timed out
+	WORKFLOW_STATUS_CANCELLED WorkflowStatus = "CANCELLED"
+)
+
+// errors the HTTP layer maps to 404 Not Found and 409 Conflict
+var (
+	ErrWorkflowNotFound = errors.New("workflow not found")
+	ErrWorkflowFinished = errors.New("workflow already finished")
+)
+
+// step states next to the ones of their task
+const (
+	STEP_STATUS_WAITING TaskStatus = "WAITING" // some parents have not finished yet
+	STEP_STATUS_SKIPPED TaskStatus = "SKIPPED" // the conditions of its edges were not met
+)
+
+// EdgeCondition decides on which outcome of the parent a step runs.
+type EdgeCondition string
+
+const (
+	EDGE_ON_SUCCESS EdgeCondition = "on_success"
+	EDGE_ON_FAILURE EdgeCondition = "on_failure" // the parent failed or timed out
+	EDGE_ALWAYS     EdgeCondition = "always"     // the parent finished in any way, skipped included
+)
+
+// WorkflowEdge makes a step wait for another one.
+type WorkflowEdge struct {
+	Step      string        `json:"step"`
+	Condition EdgeCondition `json:"condition,omitempty"` // defaults to on_success
+}
+
+// UnmarshalJSON also accepts a plain step name for an on_success edge.
+func (e *WorkflowEdge) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*e = WorkflowEdge{Step: name}
+		return nil
+	}
+	type edge WorkflowEdge
+	return json.Unmarshal(data, (*edge)(e))
+}
+
+// WorkflowStep is one task of a workflow with the steps it depends on, the rest is filled in when read.
+type WorkflowStep struct {
+	Name      string         `json:"name"`
+	Task      TaskSpec       `json:"task"`
+	DependsOn []WorkflowEdge `json:"depends_on,omitempty"`
+
+	Status     TaskStatus `json:"status"`
+	TaskID     *int       `json:"task_id,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+}
+
+// Workflow is a DAG of task steps, the steps without dependencies between them run in parallel.
+type Workflow struct {
+	ID          int            `json:"id"`
+	Name        string         `json:"name"`
+	Status      WorkflowStatus `json:"status"`
+	CreatedTime time.Time      `json:"created_time"`
+	FinishedAt  time.Time      `json:"finished_at"`
+	Steps       []WorkflowStep `json:"steps"`
+	Cancelled   bool           `json:"cancelled,omitempty"` // kept in the state file so a restart runs no more steps
+
+	index map[string]int
+}
+
+// stepFinished tells if a step reached a state it never leaves.
+func stepFinished(status TaskStatus) bool {
+	switch status {
+	case TASK_STATUS_SUCCEEDED, TASK_STATUS_FAILED, TASK_STATUS_TIMED_OUT, TASK_STATUS_CANCELLED, STEP_STATUS_SKIPPED:
+		return true
+	}
+	return false
+}
+
+// satisfiedBy tells if an edge lets its step run once the parent finished with status.
+func (e WorkflowEdge) satisfiedBy(status TaskStatus) bool {
+	switch e.Condition {
+	case EDGE_ON_FAILURE:
+		return status == TASK_STATUS_FAILED || status == TASK_STATUS_TIMED_OUT
+	case EDGE_ALWAYS:
+		return true
+	}
+	return status == TASK_STATUS_SUCCEEDED
+}
+
+// validateWorkflow checks the steps and their edges and rejects cycles.
+func validateWorkflow(steps []WorkflowStep) (map[string]int, error) {
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%w: a workflow needs at least one step", ErrInvalidTask)
+	}
+	index := make(map[string]int)
+	for i, step := range steps {
+		if step.Name == "" {
+			return nil, fmt.Errorf("%w: step %d has no name", ErrInvalidTask, i+1)
+		}
+		if _, ok := index[step.Name]; ok {
+			return nil, fmt.Errorf("%w: step %s is defined twice", ErrInvalidTask, step.Name)
+		}
+		index[step.Name] = i
+		spec, err := expandTaskTemplate(step.Task)
+		if err != nil {
+			return nil, fmt.Errorf("step %s: %w", step.Name, err)
+		}
+		steps[i].Task = spec
+		if err := validateTaskSpec(spec); err != nil {
+			return nil, fmt.Errorf("step %s: %w", step.Name, err)
+		}
+	}
+
+	// parents counts the unresolved edges of every step, the steps left once nothing can be resolved form a cycle
+	parents := make([]int, len(steps))
+	children := make(map[string][]int)
+	for i, step := range steps {
+		for _, edge := range step.DependsOn {
+			if _, ok := index[edge.Step]; !ok || edge.Step == step.Name {
+				return nil, fmt.Errorf("%w: step %s depends on unknown step %q", ErrInvalidTask, step.Name, edge.Step)
+			}
+			switch edge.Condition {
+			case "", EDGE_ON_SUCCESS, EDGE_ON_FAILURE, EDGE_ALWAYS:
+			default:
+				return nil, fmt.Errorf("%w: edge %s -> %s has unknown condition %q", ErrInvalidTask, edge.Step, step.Name, edge.Condition)
+			}
+			parents[i]++
+			children[edge.Step] = append(children[edge.Step], i)
+		}
+	}
+	ready := make([]int, 0, len(steps))
+	for i := range steps {
+		if parents[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	for n := 0; n < len(ready); n++ {
+		for _, child := range children[steps[ready[n]].Name] {
+			if parents[child]--; parents[child] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+	if len(ready) < len(steps) {
+		cycle := make([]string, 0)
+		for i, step := range steps {
+			if parents[i] > 0 {
+				cycle = append(cycle, step.Name)
+			}
+		}
+		return nil, fmt.Errorf("%w: steps %v depend on each other in a cycle", ErrInvalidTask, cycle)
+	}
+	return index, nil
+}
+
+// startStep submits the task of a step, must be called with the store lock held.
+func startStep(wf *Workflow, step *WorkflowStep) {
+	spec := step.Task
+	if spec.Description == "" {
+		spec.Description = wf.Name + "/" + step.Name
+	}
+	task := &Task{
+		TaskSpec:     spec,
+		ID:           nextTaskID(),
+		CreatedTime:  time.Now(),
+		Status:       TASK_STATUS_PENDING,
+		Workflow:     wf.ID,
+		WorkflowStep: step.Name,
+		queueIndex:   -1,
+		readyIndex:   -1,
+	}
+	tasks.tasks[task.ID] = task
+	id := task.ID
+	step.TaskID = &id
+	step.Status = TASK_STATUS_PENDING
+	scheduleTask(task)
+}
+
+// resolveWorkflow starts or skips every waiting step whose parents all finished, then settles the workflow
+// status once no step is left. Must be called with the store lock held.
+func resolveWorkflow(wf *Workflow) {
+	if wf.Status != WORKFLOW_STATUS_RUNNING {
+		return
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := range wf.Steps {
+			step := &wf.Steps[i]
+			if step.Status != STEP_STATUS_WAITING {
+				continue
+			}
+			ready, run := true, !wf.Cancelled
+			for _, edge := range step.DependsOn {
+				parent := wf.Steps[wf.index[edge.Step]].Status
+				if !stepFinished(parent) {
+					ready = false
+					break
+				}
+				if !edge.satisfiedBy(parent) {
+					run = false
+				}
+			}
+			if !ready {
+				continue
+			}
+			if run {
+				startStep(wf, step)
+			} else {
+				step.Status = STEP_STATUS_SKIPPED
+				changed = true // a skipped step may settle its children
+			}
+		}
+	}
+
+	failed, cancelled := false, wf.Cancelled
+	for _, step := range wf.Steps {
+		if !stepFinished(step.Status) {
+			return
+		}
+		switch step.Status {
+		case TASK_STATUS_FAILED, TASK_STATUS_TIMED_OUT:
+			failed = true
+		case TASK_STATUS_CANCELLED:
+			cancelled = true
+		}
+	}
+	switch {
+	case failed:
+		wf.Status = WORKFLOW_STATUS_FAILED
+	case cancelled:
+		wf.Status = WORKFLOW_STATUS_CANCELLED
+	default:
+		wf.Status = WORKFLOW_STATUS_SUCCEEDED
+	}
+	wf.FinishedAt = time.Now()
+	log.Printf("Workflow %d (%s) finished as %s", wf.ID, wf.Name, wf.Status)
+}
+
+// advanceWorkflow records the end of a step task and moves its workflow on, must be called with the store lock held.
+func advanceWorkflow(task *Task) {
+	wf, ok := tasks.workflows[task.Workflow]
+	if !ok || task.Workflow == 0 {
+		return
+	}
+	i, ok := wf.index[task.WorkflowStep]
+	if !ok {
+		return
+	}
+	wf.Steps[i].Status = task.Status
+	resolveWorkflow(wf)
+}
+
+// resumeWorkflow catches up on the steps whose task finished while the panel was down or was pruned, then
+// moves the workflow on. Must be called with the store lock held.
+func resumeWorkflow(wf *Workflow) {
+	for i := range wf.Steps {
+		step := &wf.Steps[i]
+		if step.TaskID == nil || stepFinished(step.Status) {
+			continue
+		}
+		task, ok := tasks.tasks[*step.TaskID]
+		switch {
+		case !ok:
+			step.Status = TASK_STATUS_FAILED
+		case task.IsFinished:
+			step.Status = task.Status
+		}
+	}
+	resolveWorkflow(wf)
+}
+
+// snapshot copies a workflow with the progress of the task of every step, must be called with the store lock held.
+func (wf *Workflow) snapshot() Workflow {
+	copied := *wf
+	copied.Steps = make([]WorkflowStep, len(wf.Steps))
+	for i, step := range wf.Steps {
+		if step.TaskID != nil {
+			if task, ok := tasks.tasks[*step.TaskID]; ok {
+				step.Status = task.Status
+				step.StartedAt = task.StartedAt
+				step.FinishedAt = task.FinishedAt
+				step.ExitCode = task.snapshot().ExitCode
+			}
+		}
+		copied.Steps[i] = step
+	}
+	return copied
+}
+
+// SubmitWorkflow registers a workflow and starts the steps that depend on nothing.
+func SubmitWorkflow(name string, steps []WorkflowStep) (Workflow, error) {
+	index, err := validateWorkflow(steps)
+	if err != nil {
+		return Workflow{}, err
+	}
+
+	tasks.Lock()
+	defer tasks.Unlock()
+
+	wf := &Workflow{
+		ID:          tasks.nextWorkflowID,
+		Name:        name,
+		Status:      WORKFLOW_STATUS_RUNNING,
+		CreatedTime: time.Now(),
+		Steps:       make([]WorkflowStep, len(steps)),
+		index:       index,
+	}
+	tasks.nextWorkflowID++
+	if wf.Name == "" {
+		wf.Name = fmt.Sprintf("workflow-%d", wf.ID)
+	}
+	for i, step := range steps {
+		wf.Steps[i] = WorkflowStep{Name: step.Name, Task: step.Task, DependsOn: step.DependsOn, Status: STEP_STATUS_WAITING}
+	}
+	tasks.workflows[wf.ID] = wf
+
+	resolveWorkflow(wf)
+	persistTasks()
+	return wf.snapshot(), nil
+}
+
+// ListWorkflows returns copies of every workflow, the newest first.
+func ListWorkflows() []Workflow {
+	tasks.RLock()
+	defer tasks.RUnlock()
+
+	list := make([]Workflow, 0, len(tasks.workflows))
+	for _, wf := range tasks.workflows {
+		list = append(list, wf.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return list
+}
+
+// GetWorkflow returns a copy of a workflow with the progress of its steps.
+func GetWorkflow(id int) (Workflow, error) {
+	tasks.RLock()
+	defer tasks.RUnlock()
+
+	wf, ok := tasks.workflows[id]
+	if !ok {
+		return Workflow{}, fmt.Errorf("%w: no workflow with id %d", ErrWorkflowNotFound, id)
+	}
+	return wf.snapshot(), nil
+}
+
+// CancelWorkflow cancels the steps that have not finished, the waiting ones are skipped.
+func CancelWorkflow(id int) (Workflow, error) {
+	tasks.Lock()
+	defer tasks.Unlock()
+
+	wf, ok := tasks.workflows[id]
+	if !ok {
+		return Workflow{}, fmt.Errorf("%w: no workflow with id %d", ErrWorkflowNotFound, id)
+	}
+	if wf.Status != WORKFLOW_STATUS_RUNNING {
+		return Workflow{}, fmt.Errorf("%w: workflow %d is %s", ErrWorkflowFinished, id, wf.Status)
+	}
+
+	wf.Cancelled = true
+	for _, step := range wf.Steps {
+		if step.TaskID == nil {
+			continue
+		}
+		if task, ok := tasks.tasks[*step.TaskID]; ok && !task.IsFinished {
+			stopTask(task)
+		}
+	}
+	resolveWorkflow(wf)
+	persistTasks()
+	log.Printf("Workflow %d (%s) cancelled", wf.ID, wf.Name)
+	return wf.snapshot(), nil
+}
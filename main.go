@@ -2,13 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
 	"server-monitor/api"
@@ -43,6 +47,8 @@ func updateMetrics() {
 		latestMetrics = metrics
 		metricsMutex.Unlock()
 
+		api.EvaluateAlerts(metrics, time.Now())
+
 		log.Println("Metrics updated in background.")
 	}
 }
@@ -73,13 +79,95 @@ func renderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
 	}
 }
 
+// actorOf names who made a request, for the service event history. A proxy doing authentication can pass
+// the user in X-Actor, otherwise the client address is used.
+func actorOf(r *http.Request) string {
+	if actor := r.Header.Get("X-Actor"); actor != "" {
+		return actor
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// logErrorStatus maps an error of the service logs API to its HTTP status code, anything but a broken log file
+// means the service is not installed
+func logErrorStatus(err error) int {
+	if errors.Is(err, api.ErrLogUnreadable) {
+		return http.StatusInternalServerError
+	}
+	return http.StatusNotFound
+}
+
+// taskErrorStatus maps an error of the task API to its HTTP status code
+func taskErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, api.ErrInvalidTask):
+		return http.StatusBadRequest
+	case errors.Is(err, api.ErrTaskNotFound), errors.Is(err, api.ErrWorkflowNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, api.ErrTaskNotPending), errors.Is(err, api.ErrTaskFinished), errors.Is(err, api.ErrTaskNotFinished),
+		errors.Is(err, api.ErrRecurringTaskExists), errors.Is(err, api.ErrWorkflowFinished),
+		errors.Is(err, api.ErrTaskTemplateExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// runCount reads the n query parameter of the run previews, 5 when absent
+func runCount(r *http.Request) (int, bool) {
+	n := 5
+	if value := r.URL.Query().Get("n"); value != "" {
+		if _, err := fmt.Sscan(value, &n); err != nil || n <= 0 || n > 100 {
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// writeEvent writes a single server sent event with a JSON payload
+func writeEvent(w http.ResponseWriter, event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", event, err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
+
 func main() {
+	// supervised services with limits are started through this binary, see api.RunLimitsHelper
+	api.RunLimitsHelper()
+
+	// alerts and notify tasks without a URL of their own post to this webhook, nothing is sent when it is unset
+	api.NotificationWebhookURL = os.Getenv("NOTIFY_WEBHOOK_URL")
+
 	api.InitServices()
 	api.InitTasks()
+	if _, err := api.LoadAlertRules(); err != nil {
+		log.Printf("Error loading alert rules: %v", err)
+	}
 
 	// Start the background metrics update goroutine
 	go updateMetrics()
 
+	// Apply the declarative service definitions now, on change and on SIGHUP, SIGHUP also reloads the alert rules
+	go api.WatchServiceConfig(5 * time.Second)
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			log.Println("SIGHUP received, applying service definitions")
+			if _, err := api.ApplyServiceConfig(); err != nil {
+				log.Printf("Error applying service definitions: %v", err)
+			}
+			if _, err := api.LoadAlertRules(); err != nil {
+				log.Printf("Error loading alert rules: %v", err)
+			}
+		}
+	}()
+
 	r := mux.NewRouter()
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		renderTemplate(w, "dashboard.html", Page{Current: "dashboard"})
@@ -103,8 +191,9 @@ func main() {
 
 	apiRouter.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
+			// the service spec sits next to the action, so install can register a real program
 			var actionType struct {
-				Name   string `json:"name"`
+				api.ServiceSpec
 				Action string `json:"action"`
 			}
 
@@ -115,26 +204,38 @@ func main() {
 			}
 
 			serviceName := actionType.Name
+			actor := actorOf(r)
 			var errAction error
 
 			switch actionType.Action {
 			case "install":
-				errAction = api.Install(serviceName)
+				errAction = api.Install(actionType.ServiceSpec, actor)
 			case "start":
-				errAction = api.Start(serviceName)
+				errAction = api.Start(serviceName, actor)
 			case "stop":
-				errAction = api.Stop(serviceName)
+				errAction = api.Stop(serviceName, actor)
 			case "reload":
-				errAction = api.Reload(serviceName)
+				errAction = api.Reload(serviceName, actor)
+			case "restart":
+				errAction = api.Restart(serviceName, actor)
+			case "enable":
+				errAction = api.Enable(serviceName)
+			case "disable":
+				errAction = api.Disable(serviceName)
 			case "uninstall":
-				errAction = api.Uninstall(serviceName)
+				errAction = api.Uninstall(serviceName, actor)
 			default:
 				http.Error(w, "Invalid action specified", http.StatusNotImplemented)
 				return
 			}
 
 			if errAction != nil {
-				http.Error(w, fmt.Sprintf("Error performing action '%s' on service '%s': %s", actionType.Action, serviceName, errAction.Error()), http.StatusBadRequest)
+				status := http.StatusBadRequest
+				if errors.Is(errAction, api.ErrInvalidTransition) || errors.Is(errAction, api.ErrServiceBusy) ||
+					errors.Is(errAction, api.ErrServiceRequired) {
+					status = http.StatusConflict
+				}
+				http.Error(w, fmt.Sprintf("Error performing action '%s' on service '%s': %s", actionType.Action, serviceName, errAction.Error()), status)
 				return
 			}
 
@@ -157,17 +258,141 @@ func main() {
 		}
 	}).Methods("POST", "GET")
 
+	apiRouter.HandleFunc("/services/graph", func(w http.ResponseWriter, r *http.Request) {
+		graph := api.GetServiceGraph()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(graph); err != nil {
+			log.Printf("Error encoding service graph JSON: %v", err)
+		}
+	}).Methods("GET")
+
+	apiRouter.HandleFunc("/services/plan", func(w http.ResponseWriter, r *http.Request) {
+		plan := api.PlanServiceConfig()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(plan); err != nil {
+			log.Printf("Error encoding service plan JSON: %v", err)
+		}
+	}).Methods("GET")
+
+	apiRouter.HandleFunc("/services/{name}/events", func(w http.ResponseWriter, r *http.Request) {
+		limit := 0
+		if value := r.URL.Query().Get("limit"); value != "" {
+			if _, err := fmt.Sscan(value, &limit); err != nil || limit < 0 {
+				http.Error(w, "Invalid limit value", http.StatusBadRequest)
+				return
+			}
+		}
+
+		events, err := api.GetServiceEvents(mux.Vars(r)["name"], limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(events); err != nil {
+			log.Printf("Error encoding service events JSON: %v", err)
+		}
+	}).Methods("GET")
+
+	apiRouter.HandleFunc("/services/{name}/logs", func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		query := r.URL.Query()
+
+		tail := 200
+		if value := query.Get("tail"); value != "" {
+			if _, err := fmt.Sscan(value, &tail); err != nil || tail < 0 {
+				http.Error(w, "Invalid tail value", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// since takes either an RFC3339 time or a duration back from now such as 15m
+		var since time.Time
+		if value := query.Get("since"); value != "" {
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				since = t
+			} else if d, err := time.ParseDuration(value); err == nil {
+				since = time.Now().Add(-d)
+			} else {
+				http.Error(w, "Invalid since value, expected RFC3339 time or duration", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if query.Get("follow") != "true" {
+			lines, err := api.TailServiceLogs(name, tail, since)
+			if err != nil {
+				http.Error(w, err.Error(), logErrorStatus(err))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(w).Encode(lines); err != nil {
+				log.Printf("Error encoding service logs JSON: %v", err)
+			}
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// subscribe before reading the backlog so nothing falls in between
+		live, stop, err := api.FollowServiceLogs(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer stop()
+
+		lines, err := api.TailServiceLogs(name, tail, since)
+		if err != nil {
+			http.Error(w, err.Error(), logErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		var last time.Time
+		for _, line := range lines {
+			writeEvent(w, "log", line)
+			last = line.Time
+		}
+		flusher.Flush()
+
+		for {
+			select {
+			case line := <-live:
+				if !line.Time.After(last) {
+					continue
+				}
+				writeEvent(w, "log", line)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}).Methods("GET")
+
 	apiRouter.HandleFunc("/tasks", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
-			var task api.Task
-			if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+			var spec api.TaskSpec
+			if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
 				http.Error(w, "Error decoding task data: "+err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			newTask, err := api.SubmitTask(task.Description, task.RunTime)
+			newTask, err := api.SubmitTask(spec)
 			if err != nil {
-				http.Error(w, "Error submitting task: "+err.Error(), http.StatusInternalServerError)
+				http.Error(w, "Error submitting task: "+err.Error(), taskErrorStatus(err))
 				return
 			}
 
@@ -187,32 +412,397 @@ func main() {
 				return
 			}
 
-		} else if r.Method == http.MethodDelete {
-			err := r.ParseForm()
-			if err != nil {
-				http.Error(w, "Missing or invalid task ID", http.StatusBadRequest)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}).Methods("POST", "GET")
+
+	apiRouter.HandleFunc("/tasks/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		var taskId int
+		if _, err := fmt.Sscan(mux.Vars(r)["id"], &taskId); err != nil {
+			http.Error(w, "Invalid task ID format", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			if err := api.DeleteTask(taskId); err != nil {
+				http.Error(w, "Error deleting task: "+err.Error(), taskErrorStatus(err))
 				return
 			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
 
-			taskIdString := r.Form.Get("id")
-			var taskId int
-			_, err = fmt.Sscan(taskIdString, &taskId)
+		task, err := api.GetTask(taskId)
+		if err != nil {
+			http.Error(w, err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(task); err != nil {
+			log.Printf("Error encoding task JSON: %v", err)
+		}
+	}).Methods("GET", "DELETE")
+
+	apiRouter.HandleFunc("/tasks/{id:[0-9]+}/reschedule", func(w http.ResponseWriter, r *http.Request) {
+		var taskId int
+		fmt.Sscan(mux.Vars(r)["id"], &taskId)
+
+		var body struct {
+			RunTime time.Time `json:"run_time"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		task, err := api.RescheduleTask(taskId, body.RunTime)
+		if err != nil {
+			http.Error(w, err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(task); err != nil {
+			log.Printf("Error encoding task JSON: %v", err)
+		}
+	}).Methods("POST")
+
+	apiRouter.HandleFunc("/tasks/{id:[0-9]+}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		var taskId int
+		fmt.Sscan(mux.Vars(r)["id"], &taskId)
+
+		task, err := api.CancelTask(taskId)
+		if err != nil {
+			http.Error(w, err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(task); err != nil {
+			log.Printf("Error encoding task JSON: %v", err)
+		}
+	}).Methods("POST")
+
+	apiRouter.HandleFunc("/tasks/{id:[0-9]+}/output", func(w http.ResponseWriter, r *http.Request) {
+		var taskId int
+		fmt.Sscan(mux.Vars(r)["id"], &taskId)
+
+		if r.URL.Query().Get("follow") != "true" {
+			chunks, _, stop, err := api.FollowTaskOutput(taskId)
 			if err != nil {
-				http.Error(w, "Invalid task ID format", http.StatusBadRequest)
+				http.Error(w, err.Error(), taskErrorStatus(err))
 				return
 			}
+			stop()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(w).Encode(chunks); err != nil {
+				log.Printf("Error encoding task output JSON: %v", err)
+			}
+			return
+		}
 
-			err = api.DeleteTask(taskId)
-			if err != nil {
-				http.Error(w, "Error deleting task", http.StatusNotFound)
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		chunks, live, stop, err := api.FollowTaskOutput(taskId)
+		if err != nil {
+			http.Error(w, err.Error(), taskErrorStatus(err))
+			return
+		}
+		defer stop()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		for _, chunk := range chunks {
+			writeEvent(w, "output", chunk)
+		}
+		flusher.Flush()
+
+		// the channel is closed once the task finished, the last event tells how it ended
+		for {
+			select {
+			case chunk, ok := <-live:
+				if !ok {
+					task, err := api.GetTask(taskId)
+					if err != nil {
+						return
+					}
+					writeEvent(w, "end", struct {
+						Status   api.TaskStatus `json:"status"`
+						ExitCode *int           `json:"exit_code,omitempty"`
+						Error    string         `json:"error,omitempty"`
+						Attempts int            `json:"attempts"`
+					}{task.Status, task.ExitCode, task.Error, len(task.Attempts)})
+					flusher.Flush()
+					return
+				}
+				writeEvent(w, "output", chunk)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}).Methods("GET")
+
+	apiRouter.HandleFunc("/task-templates", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(w).Encode(api.ListTaskTemplates()); err != nil {
+				log.Printf("Error encoding task templates JSON: %v", err)
+			}
+			return
+		}
+
+		var tmpl api.TaskTemplate
+		if err := json.NewDecoder(r.Body).Decode(&tmpl); err != nil {
+			http.Error(w, "Error decoding task template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := api.CreateTaskTemplate(tmpl)
+		if err != nil {
+			http.Error(w, "Error creating task template: "+err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(created); err != nil {
+			log.Printf("Error encoding task template JSON: %v", err)
+		}
+	}).Methods("GET", "POST")
+
+	apiRouter.HandleFunc("/task-templates/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		if r.Method == http.MethodDelete {
+			if err := api.DeleteTaskTemplate(name); err != nil {
+				http.Error(w, err.Error(), taskErrorStatus(err))
 				return
 			}
 			w.WriteHeader(http.StatusNoContent)
+			return
+		}
 
-		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		tmpl, err := api.GetTaskTemplate(name)
+		if err != nil {
+			http.Error(w, err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(tmpl); err != nil {
+			log.Printf("Error encoding task template JSON: %v", err)
+		}
+	}).Methods("GET", "DELETE")
+
+	apiRouter.HandleFunc("/workflows", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(w).Encode(api.ListWorkflows()); err != nil {
+				log.Printf("Error encoding workflows JSON: %v", err)
+			}
+			return
+		}
+
+		var body struct {
+			Name  string             `json:"name"`
+			Steps []api.WorkflowStep `json:"steps"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error decoding workflow: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		wf, err := api.SubmitWorkflow(body.Name, body.Steps)
+		if err != nil {
+			http.Error(w, "Error submitting workflow: "+err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(wf); err != nil {
+			log.Printf("Error encoding workflow JSON: %v", err)
+		}
+	}).Methods("GET", "POST")
+
+	apiRouter.HandleFunc("/workflows/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		fmt.Sscan(mux.Vars(r)["id"], &id)
+
+		wf, err := api.GetWorkflow(id)
+		if err != nil {
+			http.Error(w, err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(wf); err != nil {
+			log.Printf("Error encoding workflow JSON: %v", err)
+		}
+	}).Methods("GET")
+
+	apiRouter.HandleFunc("/workflows/{id:[0-9]+}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		fmt.Sscan(mux.Vars(r)["id"], &id)
+
+		wf, err := api.CancelWorkflow(id)
+		if err != nil {
+			http.Error(w, err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(wf); err != nil {
+			log.Printf("Error encoding workflow JSON: %v", err)
+		}
+	}).Methods("POST")
+
+	apiRouter.HandleFunc("/alerts", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(api.ListAlerts(r.URL.Query().Get("resolved") == "true")); err != nil {
+			log.Printf("Error encoding alerts JSON: %v", err)
 		}
-	}).Methods("POST", "GET", "DELETE")
+	}).Methods("GET")
+
+	apiRouter.HandleFunc("/alerts/rules", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(api.ListAlertRules()); err != nil {
+			log.Printf("Error encoding alert rules JSON: %v", err)
+		}
+	}).Methods("GET")
+
+	// reloads the rule files, a file with a problem leaves the rules in use untouched
+	apiRouter.HandleFunc("/alerts/rules/reload", func(w http.ResponseWriter, r *http.Request) {
+		rules, err := api.LoadAlertRules()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(rules); err != nil {
+			log.Printf("Error encoding alert rules JSON: %v", err)
+		}
+	}).Methods("POST")
+
+	apiRouter.HandleFunc("/task-pool", func(w http.ResponseWriter, r *http.Request) {
+		pool := api.GetTaskPool()
+		if r.Method == http.MethodPut {
+			var settings api.TaskPoolSettings
+			if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+				http.Error(w, "Error decoding pool settings: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			var err error
+			if pool, err = api.ConfigureTaskPool(settings); err != nil {
+				http.Error(w, err.Error(), taskErrorStatus(err))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(pool); err != nil {
+			log.Printf("Error encoding task pool JSON: %v", err)
+		}
+	}).Methods("GET", "PUT")
+
+	apiRouter.HandleFunc("/recurring-tasks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(w).Encode(api.ListRecurringTasks()); err != nil {
+				log.Printf("Error encoding recurring tasks JSON: %v", err)
+			}
+			return
+		}
+
+		var def api.RecurringTask
+		if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+			http.Error(w, "Error decoding recurring task: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := api.CreateRecurringTask(def)
+		if err != nil {
+			http.Error(w, "Error creating recurring task: "+err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(created); err != nil {
+			log.Printf("Error encoding recurring task JSON: %v", err)
+		}
+	}).Methods("GET", "POST")
+
+	// preview of a cron expression before it is saved, like ?schedule=*/15 * * * *&time_zone=Europe/Paris&n=5
+	apiRouter.HandleFunc("/recurring-tasks/preview", func(w http.ResponseWriter, r *http.Request) {
+		n, ok := runCount(r)
+		if !ok {
+			http.Error(w, "Invalid n value, expected 1 to 100", http.StatusBadRequest)
+			return
+		}
+		runs, err := api.PreviewCronSchedule(r.URL.Query().Get("schedule"), r.URL.Query().Get("time_zone"), n)
+		if err != nil {
+			http.Error(w, err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(runs); err != nil {
+			log.Printf("Error encoding schedule preview JSON: %v", err)
+		}
+	}).Methods("GET")
+
+	apiRouter.HandleFunc("/recurring-tasks/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if r.Method == http.MethodDelete {
+			if err := api.DeleteRecurringTask(name); err != nil {
+				http.Error(w, err.Error(), taskErrorStatus(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		def, err := api.GetRecurringTask(name)
+		if err != nil {
+			http.Error(w, err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(def); err != nil {
+			log.Printf("Error encoding recurring task JSON: %v", err)
+		}
+	}).Methods("GET", "DELETE")
+
+	apiRouter.HandleFunc("/recurring-tasks/{name}/next", func(w http.ResponseWriter, r *http.Request) {
+		n, ok := runCount(r)
+		if !ok {
+			http.Error(w, "Invalid n value, expected 1 to 100", http.StatusBadRequest)
+			return
+		}
+		runs, err := api.NextRecurringRuns(mux.Vars(r)["name"], n)
+		if err != nil {
+			http.Error(w, err.Error(), taskErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(runs); err != nil {
+			log.Printf("Error encoding next runs JSON: %v", err)
+		}
+	}).Methods("GET")
 
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
 
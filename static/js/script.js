@@ -4,6 +4,7 @@ document.addEventListener('DOMContentLoaded', () => {
     let taskListDiv = document.getElementById("taskDiv");
     const taskDescriptionInput = document.getElementById('taskDesc');
     const taskScheduleInput = document.getElementById('taskSchedule');
+    const taskCommandInput = document.getElementById('taskCommand');
 
     function redirectToDashboard() {
         window.location.href = "/";
@@ -81,6 +82,7 @@ document.addEventListener('DOMContentLoaded', () => {
                   <h3 class="text-lg font-semibold mb-2">Schedule New Task:</h3>
                   <div class="flex">
                       <input type="text" class="border rounded px-2 mr-2" id="taskDesc" placeholder="Enter Description"/>
+                      <input type="text" class="border rounded px-2 mr-2 font-mono" id="taskCommand" placeholder="Shell command"/>
                       <input type="datetime-local" class="border px-2 rounded mr-2" id="taskSchedule"/>
                       <button class="bg-blue-500 text-white rounded hover:bg-blue-700 py-2 px-4 font-bold" onclick="handleNewTask()">Schedule</button>
                   </div>
@@ -153,6 +155,14 @@ document.addEventListener('DOMContentLoaded', () => {
             status.textContent = `Status: ${service.Status}`;
             div.appendChild(status);
 
+            if (service.resources) {
+                const usage = document.createElement("p");
+                usage.classList.add("mb-2", "text-gray-700");
+                const current = service.resources.current;
+                usage.textContent = `CPU: ${current.cpu_percent.toFixed(1)}% | RSS: ${(current.rss / 1024 / 1024).toFixed(1)} MB | FDs: ${current.open_fds} | Threads: ${current.threads}`;
+                div.appendChild(usage);
+            }
+
             const controls = document.createElement("div");
             controls.classList.add("flex", "space-x-2");
 
@@ -229,25 +239,29 @@ document.addEventListener('DOMContentLoaded', () => {
 
             const desc = document.createElement("span");
             desc.classList.add("font-medium", "mr-2");
-            desc.textContent = `Description: ${task.Description}`;
+            desc.textContent = `Description: ${task.description}`;
             div.appendChild(desc);
 
             const status = document.createElement("span");
             status.classList.add("font-semibold", "text-gray-500");
-            status.textContent = `Finished? ${task.IsFinished}`;
+            status.textContent = task.exit_code !== undefined ? `${task.status} (exit ${task.exit_code})` : task.status;
+            if (task.error) {
+                status.title = task.error;
+            }
             div.appendChild(status);
 
+            // only finished tasks can be removed, the others are cancelled first
             const removeBtn = document.createElement("button");
             removeBtn.classList.add("bg-red-500", "hover:bg-red-700", "font-bold", "py-1", "px-2", "rounded", "text-white", "ml-auto");
-            removeBtn.textContent = "X";
-            removeBtn.onclick = () => handleRemoveTask(task.ID);
+            removeBtn.textContent = task.is_finished ? "X" : "Cancel";
+            removeBtn.onclick = () => task.is_finished ? handleRemoveTask(task.id) : handleCancelTask(task.id);
             div.appendChild(removeBtn);
             taskListDiv.appendChild(div);
         }
     }
 
     function handleRemoveTask(taskId) {
-        fetch(`/api/tasks?id=${taskId}`, {
+        fetch(`/api/tasks/${taskId}`, {
             method: "DELETE",
         })
             .then(response => {
@@ -263,12 +277,34 @@ document.addEventListener('DOMContentLoaded', () => {
             });
     }
 
+    function handleCancelTask(taskId) {
+        fetch(`/api/tasks/${taskId}/cancel`, {
+            method: "POST",
+        })
+            .then(response => {
+                if (!response.ok) {
+                    throw new Error(`Error cancelling task ${taskId}: ${response.status}`);
+                }
+            })
+            .then(() => {
+                handleTasks();
+            })
+            .catch(error => {
+                handleFetchError(undefined, error, `cancel task ${taskId}`);
+            });
+    }
+
     function handleNewTask() {
         const description = taskDescriptionInput.value.trim();
         if (description === "") {
             alert("Please add a description before scheduling a new task!");
             return;
         }
+        const command = taskCommandInput.value.trim();
+        if (command === "") {
+            alert("Please add the command the task should run!");
+            return;
+        }
         const timeValue = taskScheduleInput.value;
         if (timeValue === "") {
             alert("Time format is required!");
@@ -284,6 +320,7 @@ document.addEventListener('DOMContentLoaded', () => {
             },
             body: JSON.stringify({
                 description: description,
+                shell: command,
                 run_time: runTime
             })
         })
@@ -292,6 +329,7 @@ document.addEventListener('DOMContentLoaded', () => {
                     throw new Error(`Error scheduling new task: ${response.status}`);
                 }
                 taskDescriptionInput.value = "";
+                taskCommandInput.value = "";
                 taskScheduleInput.value = "";
             })
             .then(() => {